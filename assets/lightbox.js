@@ -0,0 +1,23 @@
+// Opens gallery images in a modal along with their title, caption and
+// camera info instead of navigating away to the raw image.
+(function () {
+    const modal = document.getElementById('lightbox')
+    if (!modal) {
+        return
+    }
+    document.addEventListener('click', function (e) {
+        const link = e.target.closest('a.lightbox-link')
+        if (!link || !window.jQuery) {
+            return
+        }
+        e.preventDefault()
+        const img = modal.querySelector('.lightbox-image')
+        img.src = link.href
+        img.alt = link.dataset.alt
+        modal.querySelector('.modal-title').textContent = link.dataset.title
+        modal.querySelector('.lightbox-caption').textContent = link.dataset.caption
+        modal.querySelector('.lightbox-camera').textContent =
+            [link.dataset.camera, link.dataset.exposure].filter(Boolean).join(' · ')
+        window.jQuery(modal).modal('show')
+    })
+})()
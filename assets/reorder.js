@@ -0,0 +1,43 @@
+// Drag to reorder the images on the gallery edit page.  Nothing is saved
+// until the reorder form is submitted, which sends every filename in the
+// order they are shown.
+(function () {
+    const container = document.getElementById('sortableImages')
+    const form = document.getElementById('reorderImagesForm')
+    if (!container || !form) {
+        return
+    }
+    const button = form.querySelector('button')
+    let dragged = null
+
+    container.addEventListener('dragstart', function (e) {
+        dragged = e.target.closest('[data-filename]')
+        e.dataTransfer.effectAllowed = 'move'
+    })
+    container.addEventListener('dragover', function (e) {
+        const target = e.target.closest('[data-filename]')
+        if (!dragged || !target || target === dragged) {
+            return
+        }
+        e.preventDefault()
+        const rect = target.getBoundingClientRect()
+        const after = e.clientX > rect.left + rect.width / 2
+        container.insertBefore(dragged, after ? target.nextSibling : target)
+        button.disabled = false
+    })
+    container.addEventListener('drop', function (e) {
+        e.preventDefault()
+    })
+    container.addEventListener('dragend', function () {
+        dragged = null
+    })
+    form.addEventListener('submit', function () {
+        container.querySelectorAll('[data-filename]').forEach(function (el) {
+            const input = document.createElement('input')
+            input.type = 'hidden'
+            input.name = 'filenames'
+            input.value = el.dataset.filename
+            form.appendChild(input)
+        })
+    })
+})()
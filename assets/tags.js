@@ -0,0 +1,48 @@
+// Tag autocomplete for the gallery edit page.
+//
+// Inputs marked with data-tag-autocomplete hold a comma separated list of
+// tags.  While typing, the owner's existing tags that start with the last
+// tag in the list are offered through a datalist.
+(function () {
+    const inputs = document.querySelectorAll('[data-tag-autocomplete]')
+    if (inputs.length === 0 || !window.fetch) {
+        return
+    }
+    const datalist = document.createElement('datalist')
+    datalist.id = 'tagSuggestions'
+    document.body.appendChild(datalist)
+    let timer = null
+
+    async function suggest(input) {
+        const parts = input.value.split(',')
+        const prefix = parts.pop().trim()
+        if (prefix === '') {
+            datalist.innerHTML = ''
+            return
+        }
+        const resp = await fetch('/tags/autocomplete?q=' + encodeURIComponent(prefix), {
+            credentials: 'same-origin'
+        })
+        if (!resp.ok) {
+            return
+        }
+        const tags = await resp.json()
+        const head = parts.map(function (p) { return p.trim() }).filter(Boolean)
+        datalist.innerHTML = ''
+        tags.forEach(function (tag) {
+            const option = document.createElement('option')
+            option.value = head.concat([tag]).join(', ')
+            datalist.appendChild(option)
+        })
+    }
+
+    inputs.forEach(function (input) {
+        input.setAttribute('list', datalist.id)
+        input.addEventListener('input', function () {
+            clearTimeout(timer)
+            timer = setTimeout(function () {
+                suggest(input).catch(function () {})
+            }, 150)
+        })
+    })
+})()
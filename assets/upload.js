@@ -0,0 +1,178 @@
+// Resumable image uploads for the gallery edit page.
+//
+// Every file is sent in chunks to /galleries/:id/uploads.  The id of each
+// upload is remembered in localStorage so that picking the same file again
+// after a dropped connection or a page reload resumes where it left off
+// instead of starting over.
+(function () {
+    const form = document.getElementById('imageUploadForm')
+    if (!form || !window.fetch) {
+        return
+    }
+    const chunkSize = 1 << 20
+    const maxParallel = 3
+    const maxRetries = 8
+    const uploadsURL = form.dataset.uploads
+    const csrfToken = form.dataset.csrf
+    const dropZone = document.getElementById('dropZone')
+    const input = document.getElementById('images')
+    const list = document.getElementById('uploadList')
+
+    function storageKey(file) {
+        return ['upload', uploadsURL, file.name, file.size, file.lastModified].join(':')
+    }
+
+    function sleep(ms) {
+        return new Promise(function (resolve) { setTimeout(resolve, ms) })
+    }
+
+    async function request(method, url, body, headers) {
+        headers = Object.assign({'X-CSRF-Token': csrfToken}, headers || {})
+        const resp = await fetch(url, {
+            method: method,
+            body: body,
+            headers: headers,
+            credentials: 'same-origin'
+        })
+        let data = {}
+        try {
+            data = await resp.json()
+        } catch (e) {}
+        return {status: resp.status, data: data}
+    }
+
+    function addRow(file) {
+        const li = document.createElement('li')
+        li.className = 'my-2'
+        li.innerHTML = '<div class="d-flex justify-content-between">' +
+            '<span class="upload-name"></span><span class="upload-status text-muted">Waiting</span></div>' +
+            '<div class="progress"><div class="progress-bar" role="progressbar" style="width: 0%"></div></div>'
+        li.querySelector('.upload-name').textContent = file.name
+        list.appendChild(li)
+        return {
+            progress: function (offset) {
+                const pct = file.size ? Math.floor(100 * offset / file.size) : 100
+                li.querySelector('.progress-bar').style.width = pct + '%'
+                li.querySelector('.upload-status').textContent = pct + '%'
+            },
+            status: function (text, level) {
+                const status = li.querySelector('.upload-status')
+                status.textContent = text
+                status.className = 'upload-status text-' + level
+                if (level === 'danger') {
+                    li.querySelector('.progress-bar').classList.add('bg-danger')
+                }
+            }
+        }
+    }
+
+    // start returns the server side state of the file's upload, resuming
+    // a previous one when it still exists
+    async function start(file) {
+        const key = storageKey(file)
+        const id = localStorage.getItem(key)
+        if (id) {
+            const resp = await request('GET', uploadsURL + '/' + id)
+            if (resp.status === 200) {
+                return resp.data
+            }
+            localStorage.removeItem(key)
+        }
+        const body = new URLSearchParams({filename: file.name, size: file.size})
+        const resp = await request('POST', uploadsURL, body)
+        if (resp.status !== 201) {
+            throw new Error(resp.data.error || 'Could not start upload')
+        }
+        localStorage.setItem(key, resp.data.id)
+        return resp.data
+    }
+
+    async function upload(file, row) {
+        let state = await start(file)
+        row.progress(state.offset)
+        let retries = 0
+        while (!state.complete) {
+            const chunk = file.slice(state.offset, state.offset + chunkSize)
+            let resp
+            try {
+                resp = await request('PATCH', uploadsURL + '/' + state.id, chunk,
+                    {'Upload-Offset': String(state.offset)})
+            } catch (e) {
+                resp = {status: 0, data: {}}
+            }
+            if (resp.status === 200 || resp.status === 409) {
+                // a conflict tells us where the server actually is
+                state = resp.data
+                retries = 0
+                row.progress(state.offset)
+                continue
+            }
+            if (resp.status >= 400 && resp.status < 500) {
+                localStorage.removeItem(storageKey(file))
+                throw new Error(resp.data.error || 'Upload rejected')
+            }
+            if (++retries > maxRetries) {
+                throw new Error('Connection lost, choose the file again to resume')
+            }
+            row.status('Retrying…', 'warning')
+            await sleep(Math.min(30000, 500 * Math.pow(2, retries)))
+            const status = await request('GET', uploadsURL + '/' + state.id).catch(function () {
+                return {status: 0}
+            })
+            if (status.status === 200) {
+                state = status.data
+            }
+        }
+        localStorage.removeItem(storageKey(file))
+        row.status('Done', 'success')
+    }
+
+    async function uploadAll(files) {
+        const queue = Array.from(files).map(function (file) {
+            return {file: file, row: addRow(file)}
+        })
+        let failed = 0
+        async function worker() {
+            while (queue.length > 0) {
+                const item = queue.shift()
+                try {
+                    await upload(item.file, item.row)
+                } catch (e) {
+                    failed++
+                    item.row.status(e.message, 'danger')
+                }
+            }
+        }
+        const workers = []
+        for (let i = 0; i < maxParallel; i++) {
+            workers.push(worker())
+        }
+        await Promise.all(workers)
+        if (failed === 0) {
+            window.location.reload()
+        }
+    }
+
+    form.addEventListener('submit', function (e) {
+        e.preventDefault()
+        if (input.files.length > 0) {
+            uploadAll(input.files)
+            input.value = ''
+        }
+    })
+    ;['dragenter', 'dragover'].forEach(function (name) {
+        dropZone.addEventListener(name, function (e) {
+            e.preventDefault()
+            dropZone.classList.add('drop-zone-active')
+        })
+    })
+    ;['dragleave', 'drop'].forEach(function (name) {
+        dropZone.addEventListener(name, function (e) {
+            e.preventDefault()
+            dropZone.classList.remove('drop-zone-active')
+        })
+    })
+    dropZone.addEventListener('drop', function (e) {
+        uploadAll(e.dataTransfer.files)
+    })
+})()
@@ -0,0 +1,64 @@
+// Package buildinfo reports which build of the site is running so
+// deployments can be checked.  Commit and BuildTime can be set when
+// building with
+//
+//	go build -ldflags "-X lenslocked.com/buildinfo.Commit=$(git rev-parse HEAD) -X lenslocked.com/buildinfo.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// otherwise the commit is taken from the version control information Go
+// records in the binary.
+package buildinfo
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+var (
+	// Commit is the git commit the binary was built from
+	Commit string
+	// BuildTime is when the binary was built
+	BuildTime string
+)
+
+// Info describes the running build
+type Info struct {
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	// CommitTime is when Commit was made and Modified is set when the
+	// binary was built with uncommitted changes
+	CommitTime string `json:"commit_time,omitempty"`
+	Modified   bool   `json:"modified"`
+	GoVersion  string `json:"go_version"`
+}
+
+// Read returns the build info of the running binary, anything that is not
+// known is left as "unknown"
+func Read() Info {
+	info := Info{
+		Commit:    Commit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		info.GoVersion = bi.GoVersion
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = s.Value
+				}
+			case "vcs.time":
+				info.CommitTime = s.Value
+			case "vcs.modified":
+				info.Modified = s.Value == "true"
+			}
+		}
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildTime == "" {
+		info.BuildTime = "unknown"
+	}
+	return info
+}
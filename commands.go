@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"lenslocked.com/models"
+	"lenslocked.com/rand"
+)
+
+// command is a subcommand of lenslocked, its name may be several words
+// like "user create".  run is passed the arguments after the name.
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+// commands are what lenslocked can do, every command takes the config
+// flags along with its own
+func commands() []command {
+	return []command{
+		{"serve", "run the web server, the default when no command is given", runServe},
+		{"migrate", "migrate the database, -reset -yes drops every table first", runMigrate},
+		{"config check", "print the effective config and the problems with it", runConfigCheck},
+		{"user create", "create a user with -email and -name, -admin makes them an admin", runUserCreate},
+		{"user disable", "disable the user with -email and log them out", runUserDisable},
+		{"user reset-password", "give the user with -email a new temporary password", runUserResetPassword},
+		{"gallery list", "list every gallery, largest first", runGalleryList},
+		{"gallery delete", "delete the gallery with -id along with its images", runGalleryDelete},
+		{"seed", "create a demo user with galleries, not allowed in prod", runSeed},
+		{"gc-images", "remove images of deleted galleries and abandoned uploads", runGCImages},
+		{"help", "list the commands", runHelp},
+	}
+}
+
+// findCommand returns the command named by the start of args along with
+// the arguments left for it.  Without a command, or when args start with
+// a flag, the server is run so `lenslocked -prod` keeps working.
+func findCommand(args []string) (*command, []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return &commands()[0], args
+	}
+	var found *command
+	var rest []string
+	for _, cmd := range commands() {
+		words := strings.Fields(cmd.name)
+		if len(words) > len(args) || (found != nil && len(words) <= len(strings.Fields(found.name))) {
+			continue
+		}
+		if strings.Join(args[:len(words)], " ") == cmd.name {
+			cmd := cmd
+			found, rest = &cmd, args[len(words):]
+		}
+	}
+	return found, rest
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: lenslocked [command] [flags]")
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands() {
+		fmt.Fprintf(tw, "  %s\t%s\n", cmd.name, cmd.usage)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "run lenslocked <command> -h for the flags of a command")
+}
+
+// lenslocked help
+func runHelp(args []string) error {
+	printUsage(os.Stdout)
+	return nil
+}
+
+// newFlagSet returns the flags of the command with the config flags
+// already registered
+func newFlagSet(name string) (*flag.FlagSet, *ConfigFlags) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	return fs, RegisterConfigFlags(fs)
+}
+
+// newServices opens the database and sets up every service with cfg,
+// queries are only counted when m is not nil
+func newServices(cfg *Config, m models.Metrics) (*models.Services, error) {
+	dbCnfg := cfg.Database
+	opts := []models.ServicesConfig{
+		models.WithGorm(dbCnfg.Dialect(), dbCnfg.ConnectionInfo()),
+		models.WithLogger(slog.Default()),
+	}
+	if m != nil {
+		opts = append(opts, models.WithMetrics(m))
+	}
+	opts = append(opts,
+		models.WithUser(cfg.Pepper, cfg.HMACKey),
+		models.WithGallery(),
+		models.WithCollection(),
+		models.WithImage(),
+		models.WithUpload(),
+		models.WithSearch(),
+		models.WithCollaborator(cfg.HMACKey),
+		models.WithAdmin(),
+		models.WithAudit(),
+		models.WithLogMode(cfg.Log.Debug()),
+	)
+	return models.NewServices(opts...)
+}
+
+// openServices loads the config with the parsed flags and sets up the
+// services with it for commands run from the command line
+func openServices(cfgFlags *ConfigFlags) (*Config, *models.Services, error) {
+	cfg, err := LoadConfig(cfgFlags)
+	if err != nil {
+		return nil, nil, err
+	}
+	slog.SetDefault(cfg.Log.NewLogger(os.Stderr))
+	services, err := newServices(cfg, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, services, nil
+}
+
+// runConfigCheck prints the effective config with its secrets redacted,
+// the problems found with it are returned
+// lenslocked config check [flags]
+func runConfigCheck(args []string) error {
+	fs, cfgFlags := newFlagSet("config check")
+	fs.Parse(args)
+
+	cfg, err := buildConfig(cfgFlags)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(cfg.Redacted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "config ok")
+	return nil
+}
+
+// runMigrate migrates the database, with -reset every table is dropped
+// and created again which loses all data so it also needs -yes
+// lenslocked migrate [-reset -yes] [flags]
+func runMigrate(args []string) error {
+	fs, cfgFlags := newFlagSet("migrate")
+	reset := fs.Bool("reset", false, "drop every table before migrating, all data is lost")
+	yes := fs.Bool("yes", false, "confirm -reset")
+	fs.Parse(args)
+	if *reset && !*yes {
+		return errors.New("-reset drops every table, pass -yes as well to do it")
+	}
+
+	_, services, err := openServices(cfgFlags)
+	if err != nil {
+		return err
+	}
+	defer services.Close()
+	if *reset {
+		if err := services.DestructiveReset(); err != nil {
+			return err
+		}
+		fmt.Println("database reset")
+		return nil
+	}
+	if err := services.AutoMigrate(); err != nil {
+		return err
+	}
+	fmt.Println("database migrated")
+	return nil
+}
+
+// runUserCreate creates a user.  Unless the password is read from stdin a
+// temporary one is generated and printed, the user has to change it when
+// they first log in.
+// lenslocked user create -email -name [-admin] [-password-stdin] [flags]
+func runUserCreate(args []string) error {
+	fs, cfgFlags := newFlagSet("user create")
+	address := fs.String("email", "", "email address of the user")
+	name := fs.String("name", "", "name of the user")
+	admin := fs.Bool("admin", false, "make the user an admin")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from the first line of stdin")
+	fs.Parse(args)
+	if *address == "" || *name == "" {
+		return errors.New("-email and -name are required")
+	}
+
+	_, services, err := openServices(cfgFlags)
+	if err != nil {
+		return err
+	}
+	defer services.Close()
+	user := models.User{Name: *name, Email: *address, Admin: *admin}
+	temporary, err := setPassword(&user, *passwordStdin)
+	if err != nil {
+		return err
+	}
+	if err := services.User.As(models.Actor{}).Create(&user); err != nil {
+		return err
+	}
+	fmt.Printf("created user %d %s\n", user.ID, user.Email)
+	printTemporary(temporary)
+	return nil
+}
+
+// runUserDisable stops a user from logging in and logs them out
+// lenslocked user disable -email [flags]
+func runUserDisable(args []string) error {
+	fs, cfgFlags := newFlagSet("user disable")
+	address := fs.String("email", "", "email address of the user")
+	fs.Parse(args)
+	if *address == "" {
+		return errors.New("-email is required")
+	}
+
+	_, services, err := openServices(cfgFlags)
+	if err != nil {
+		return err
+	}
+	defer services.Close()
+	return updateUser(services, *address, models.AdminDisableUser, func(user *models.User) error {
+		user.Disabled = true
+		return nil
+	})
+}
+
+// runUserResetPassword logs a user out and gives them a temporary password
+// which is printed, they have to choose a new one when they next log in
+// lenslocked user reset-password -email [-password-stdin] [flags]
+func runUserResetPassword(args []string) error {
+	fs, cfgFlags := newFlagSet("user reset-password")
+	address := fs.String("email", "", "email address of the user")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from the first line of stdin")
+	fs.Parse(args)
+	if *address == "" {
+		return errors.New("-email is required")
+	}
+
+	_, services, err := openServices(cfgFlags)
+	if err != nil {
+		return err
+	}
+	defer services.Close()
+	var temporary string
+	err = updateUser(services, *address, models.AdminResetPassword, func(user *models.User) error {
+		temporary, err = setPassword(user, *passwordStdin)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	printTemporary(temporary)
+	return nil
+}
+
+// runGalleryList prints a page of every user's galleries, largest first
+// lenslocked gallery list [-page] [flags]
+func runGalleryList(args []string) error {
+	fs, cfgFlags := newFlagSet("gallery list")
+	page := fs.Int("page", 1, "page of galleries to list")
+	fs.Parse(args)
+	if *page < 1 {
+		return errors.New("-page must be at least 1")
+	}
+
+	_, services, err := openServices(cfgFlags)
+	if err != nil {
+		return err
+	}
+	defer services.Close()
+	galleries, total, err := services.Admin.Galleries((*page-1)*models.AdminPageSize, models.AdminPageSize)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tOWNER\tIMAGES\tSTORAGE\tPRIVATE\tTITLE")
+	for _, g := range galleries {
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%s\t%t\t%s\n", g.ID, g.OwnerEmail, g.Images, g.Storage(), g.Private, g.Title)
+	}
+	tw.Flush()
+	pages := (total + models.AdminPageSize - 1) / models.AdminPageSize
+	fmt.Printf("page %d of %d, %d galleries\n", *page, pages, total)
+	return nil
+}
+
+// runGalleryDelete deletes a gallery along with its images, like an admin
+// removing it from the dashboard
+// lenslocked gallery delete -id [flags]
+func runGalleryDelete(args []string) error {
+	fs, cfgFlags := newFlagSet("gallery delete")
+	id := fs.Uint("id", 0, "ID of the gallery")
+	fs.Parse(args)
+	if *id == 0 {
+		return errors.New("-id is required")
+	}
+
+	_, services, err := openServices(cfgFlags)
+	if err != nil {
+		return err
+	}
+	defer services.Close()
+	gallery, err := services.Gallery.ByID(*id)
+	if err != nil {
+		return err
+	}
+	images, err := services.Image.ByGalleryID(gallery.ID)
+	if err != nil {
+		return err
+	}
+	is := services.Image.As(models.Actor{})
+	for i := range images {
+		if err := is.Delete(&images[i]); err != nil {
+			return err
+		}
+	}
+	if err := services.Gallery.As(models.Actor{}).Delete(gallery.ID); err != nil {
+		return err
+	}
+	models.RecordEvent(services.Audit, models.Actor{}, models.AdminRemoveGallery, models.TargetGallery, gallery.ID,
+		map[string]interface{}{"title": gallery.Title, "owner_id": gallery.UserID, "images": len(images)})
+	fmt.Printf("deleted gallery %d %q with %d images\n", gallery.ID, gallery.Title, len(images))
+	return nil
+}
+
+// runSeed creates a demo user with a collection and a couple of galleries
+// to try the site with.  The database is migrated first.
+// lenslocked seed [-email] [flags]
+func runSeed(args []string) error {
+	fs, cfgFlags := newFlagSet("seed")
+	address := fs.String("email", "demo@lenslocked.com", "email address of the demo user")
+	fs.Parse(args)
+
+	cfg, services, err := openServices(cfgFlags)
+	if err != nil {
+		return err
+	}
+	defer services.Close()
+	if cfg.InProd() {
+		return errors.New("refusing to seed the database in prod")
+	}
+	if err := services.AutoMigrate(); err != nil {
+		return err
+	}
+	user := models.User{Name: "Demo User", Email: *address}
+	password, err := setPassword(&user, false)
+	if err != nil {
+		return err
+	}
+	// the demo account keeps the generated password
+	user.PasswordResetRequired = false
+	if err := services.User.As(models.Actor{}).Create(&user); err != nil {
+		return fmt.Errorf("creating %s: %v", *address, err)
+	}
+	collection := models.Collection{UserID: user.ID, Title: "Demo Collection"}
+	if err := services.Collection.Create(&collection); err != nil {
+		return err
+	}
+	gs := services.Gallery.As(models.Actor{UserID: user.ID})
+	galleries := []models.Gallery{
+		{UserID: user.ID, Title: "Holiday", CollectionID: collection.ID},
+		{UserID: user.ID, Title: "Wedding", CollectionID: collection.ID},
+		{UserID: user.ID, Title: "Drafts", Private: true},
+	}
+	for i := range galleries {
+		if err := gs.Create(&galleries[i]); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("created user %d %s with %d galleries\n", user.ID, user.Email, len(galleries))
+	fmt.Printf("password: %s\n", password)
+	return nil
+}
+
+// runGCImages removes the images left on disk and in the database by
+// deleted galleries, along with the files of uploads that never finished.
+// Files changed in the last day are kept so it can run while serving.
+// lenslocked gc-images [-dry-run] [flags]
+func runGCImages(args []string) error {
+	fs, cfgFlags := newFlagSet("gc-images")
+	dryRun := fs.Bool("dry-run", false, "only list what would be removed")
+	fs.Parse(args)
+
+	_, services, err := openServices(cfgFlags)
+	if err != nil {
+		return err
+	}
+	defer services.Close()
+	report, err := services.CollectGarbage(*dryRun)
+	if err != nil {
+		return err
+	}
+	for _, path := range report.Paths {
+		fmt.Println(path)
+	}
+	verb := "removed"
+	if *dryRun {
+		verb = "would remove"
+	}
+	fmt.Printf("%s %d files and directories and %d image records\n", verb, len(report.Paths), report.Images)
+	return nil
+}
+
+// updateUser applies change to the user with the email address, logs them
+// out of every session and records action in the audit log
+func updateUser(services *models.Services, address, action string, change func(*models.User) error) error {
+	user, err := services.User.ByEmail(address)
+	if err != nil {
+		return fmt.Errorf("finding %s: %v", address, err)
+	}
+	if err := change(user); err != nil {
+		return err
+	}
+	// logging out saves the change along with the new token
+	if err := services.User.As(models.Actor{}).LogOut(user); err != nil {
+		return err
+	}
+	models.RecordEvent(services.Audit, models.Actor{}, action, models.TargetUser, user.ID,
+		map[string]interface{}{"email": user.Email})
+	fmt.Printf("updated user %d %s\n", user.ID, user.Email)
+	return nil
+}
+
+// setPassword gives the user the first line of stdin as their password, or
+// when fromStdin is not set a generated one they must change when they
+// next log in.  The generated password is returned, it cannot be read
+// back from the user once it has been hashed.
+func setPassword(user *models.User, fromStdin bool) (string, error) {
+	if fromStdin {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		user.Password = strings.TrimRight(line, "\r\n")
+		if user.Password == "" {
+			return "", models.ErrPasswordRequired
+		}
+		user.PasswordResetRequired = false
+		return "", nil
+	}
+	password, err := rand.String(12)
+	if err != nil {
+		return "", err
+	}
+	user.Password = password
+	user.PasswordResetRequired = true
+	return password, nil
+}
+
+// printTemporary prints a generated password, it is the only time it is
+// shown
+func printTemporary(password string) {
+	if password != "" {
+		fmt.Printf("temporary password: %s\n", password)
+	}
+}
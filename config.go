@@ -1,14 +1,28 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 )
 
 const (
 	// ConfigFilename is the path to the location of the config file which should be at the root directory
 	ConfigFilename = ".config.json"
+	// envPrefix starts the name of every environment variable the config
+	// is read from
+	envPrefix = "LENSLOCKED_"
+	// fileEnvSuffix ends the name of environment variables that hold the
+	// path of a file to read a setting from
+	fileEnvSuffix = "_FILE"
 )
 
 // DefaultPostgresConfig returns a PostgresConfig that has all of the default
@@ -51,6 +65,112 @@ func (c DatabaseConfig) ConnectionInfo() string {
 	)
 }
 
+// MailConfig holds the SMTP server used to send emails, when no host is
+// set emails are written to the log instead.  Emails hold invitation
+// tokens so a host is required in prod.
+type MailConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+}
+
+// TLSConfig turns on serving https, either with the certificate in
+// CertFile and KeyFile or with certificates for AutocertHosts fetched from
+// Let's Encrypt.  When it is on, plain http requests to RedirectPort are
+// redirected to https.
+type TLSConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// AutocertHosts are the domains to fetch certificates for, they are
+	// kept in AutocertCache so they survive restarts
+	AutocertHosts []string `json:"autocert_hosts"`
+	AutocertCache string   `json:"autocert_cache"`
+	// RedirectPort is where plain http is redirected from, 0 turns the
+	// redirect off.  Autocert also answers its challenges there.
+	RedirectPort int `json:"redirect_port"`
+	// HSTSMaxAge is how many seconds browsers should only use https for
+	HSTSMaxAge int `json:"hsts_max_age"`
+}
+
+// Enabled reports if the site is served over https
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || c.Autocert()
+}
+
+// Autocert reports if certificates are fetched from Let's Encrypt
+func (c TLSConfig) Autocert() bool {
+	return len(c.AutocertHosts) > 0
+}
+
+// DefaultTLSConfig returns the settings used once TLS is turned on, it is
+// off until a certificate or autocert hosts are set
+func DefaultTLSConfig() TLSConfig {
+	return TLSConfig{
+		AutocertCache: "certs",
+		RedirectPort:  80,
+		HSTSMaxAge:    365 * 24 * 60 * 60,
+	}
+}
+
+// ServerConfig tunes the http server, times are in seconds and 0 means no
+// timeout.  The read and write timeouts have to allow for slow uploads.
+type ServerConfig struct {
+	ReadTimeout  int `json:"read_timeout"`
+	WriteTimeout int `json:"write_timeout"`
+	IdleTimeout  int `json:"idle_timeout"`
+	// TransferTimeout replaces the read and write timeouts for gallery zip
+	// downloads and imports, which can be gigabytes
+	TransferTimeout int `json:"transfer_timeout"`
+	// DrainDelay is how long /readyz reports the site is shutting down
+	// while it still serves requests, so load balancers stop sending new
+	// ones first.  ShutdownTimeout is how long requests in flight then get
+	// to finish.
+	DrainDelay      int `json:"drain_delay"`
+	ShutdownTimeout int `json:"shutdown_timeout"`
+	MaxHeaderBytes  int `json:"max_header_bytes"`
+}
+
+// DefaultServerConfig returns timeouts that let uploads of a few hundred
+// megabytes finish on a slow connection
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		ReadTimeout:     10 * 60,
+		WriteTimeout:    10 * 60,
+		IdleTimeout:     2 * 60,
+		TransferTimeout: 4 * 60 * 60,
+		DrainDelay:      5,
+		ShutdownTimeout: 60,
+		MaxHeaderBytes:  1 << 20,
+	}
+}
+
+// LogConfig sets how much is logged and how, Level is one of debug, info,
+// warn or error and Format is text or json.  Database queries are only
+// logged at debug.
+type LogConfig struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+}
+
+// NewLogger returns a logger that writes to w as configured, the config
+// must have been validated
+func (c LogConfig) NewLogger(w io.Writer) *slog.Logger {
+	var level slog.Level
+	level.UnmarshalText([]byte(c.Level))
+	opts := &slog.HandlerOptions{Level: level}
+	if c.Format == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// Debug reports if debug messages, like database queries, are logged
+func (c LogConfig) Debug() bool {
+	return strings.EqualFold(c.Level, "debug")
+}
+
 // DefaultConfig returns the default configuration which is the
 // host port on 8080 and the environment of the application in development
 func DefaultConfig() *Config {
@@ -59,35 +179,218 @@ func DefaultConfig() *Config {
 		Env:      "dev",
 		Pepper:   "nubis",
 		HMACKey:  "secret-hmac-key",
+		CSRFKey:  "Gvv0+DpuC/8GAhJlZ9peCyHXHKtNT3HUeiNv7D0bAT0=",
+		BaseURL:  "http://localhost:8080",
 		Database: DefaultPostgresConfig(),
+		TLS:      DefaultTLSConfig(),
+		Server:   DefaultServerConfig(),
+		Log:      LogConfig{Level: "info", Format: "text"},
 	}
 }
 
-// LoadConfig attempts to load the configuration based of a .config json
-// if a configuration is deemed to be required. If the configuration is not required
-// or the function fails to load a config file the default configuration is used instead
-func LoadConfig(cfgReq bool) (*Config, error) {
-	if !cfgReq {
-		fmt.Println("using default configuration")
-		return DefaultConfig(), nil
+// ConfigFlags are the command line flags that are applied over the config
+// file and environment variables
+type ConfigFlags struct {
+	// Path is the config file to read and Required makes a missing file an
+	// error rather than falling back to the defaults
+	Path     string
+	Required bool
+	Port     int
+	Env      string
+	BaseURL  string
+	fs       *flag.FlagSet
+}
+
+// RegisterConfigFlags adds the flags that configure the application to fs,
+// they are read once fs has been parsed
+func RegisterConfigFlags(fs *flag.FlagSet) *ConfigFlags {
+	f := &ConfigFlags{fs: fs}
+	fs.StringVar(&f.Path, "config", ConfigFilename, "path to the json config file")
+	fs.BoolVar(&f.Required, "prod", false, "set to true in production to ensure that the config file is used")
+	fs.IntVar(&f.Port, "port", 0, "port to listen on, overrides the config")
+	fs.StringVar(&f.Env, "env", "", "environment to run in (dev or prod), overrides the config")
+	fs.StringVar(&f.BaseURL, "base-url", "", "url the site is reached at, overrides the config")
+	return f
+}
+
+// apply sets the fields of cfg for the flags that were passed
+func (f *ConfigFlags) apply(cfg *Config) {
+	f.fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "port":
+			cfg.Port = f.Port
+		case "env":
+			cfg.Env = f.Env
+		case "base-url":
+			cfg.BaseURL = f.BaseURL
+		}
+	})
+}
+
+// LoadConfig builds the configuration in layers, each overriding the one
+// before it: the defaults, the config file, environment variables and
+// finally the command line flags.  The result must pass Validate.
+func LoadConfig(flags *ConfigFlags) (*Config, error) {
+	cfg, err := buildConfig(flags)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// buildConfig layers the config without validating it
+func buildConfig(flags *ConfigFlags) (*Config, error) {
+	cfg := DefaultConfig()
+	if err := loadConfigFile(cfg, flags.Path, flags.Required); err != nil {
+		return nil, err
+	}
+	if err := applyEnv(cfg, os.LookupEnv); err != nil {
+		return nil, err
+	}
+	flags.apply(cfg)
+	return cfg, nil
+}
+
+// loadConfigFile decodes the json file at path over cfg, settings missing
+// from the file keep their value.  A missing file is only an error when it
+// is required.  Unknown settings are an error so typos are not silently
+// ignored.
+func loadConfigFile(cfg *Config, path string, required bool) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && !required {
+		slog.Info("no config file found, using defaults and environment", "path", path)
+		return nil
 	}
-	f, err := os.Open(ConfigFilename)
 	if err != nil {
-		if cfgReq {
-			return nil, err
-		}
-		fmt.Println("no config found using default config")
-		return DefaultConfig(), nil
+		return err
 	}
 	defer f.Close()
-
-	var cfg Config
 	dec := json.NewDecoder(f)
-	if err := dec.Decode(&cfg); err != nil {
-		return nil, err
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("config: reading %s: %v", path, err)
+	}
+	slog.Info("loaded config", "path", path)
+	return nil
+}
+
+// envVar is a setting that can be set with the environment variable named
+// by envPrefix followed by name
+type envVar struct {
+	name string
+	// dst is a *string, *int or *[]string, lists are comma separated
+	dst interface{}
+}
+
+// envVars lists every setting that can be set from the environment
+func (c *Config) envVars() []envVar {
+	return []envVar{
+		{"PORT", &c.Port},
+		{"ENV", &c.Env},
+		{"PEPPER", &c.Pepper},
+		{"HMAC_KEY", &c.HMACKey},
+		{"CSRF_KEY", &c.CSRFKey},
+		{"CSRF_PREVIOUS_KEYS", &c.CSRFPreviousKeys},
+		{"METRICS_TOKEN", &c.MetricsToken},
+		{"LOG_LEVEL", &c.Log.Level},
+		{"LOG_FORMAT", &c.Log.Format},
+		{"BASE_URL", &c.BaseURL},
+		{"ADMINS", &c.Admins},
+		{"DB_HOST", &c.Database.Host},
+		{"DB_PORT", &c.Database.Port},
+		{"DB_USER", &c.Database.User},
+		{"DB_PASSWORD", &c.Database.Password},
+		{"DB_NAME", &c.Database.Name},
+		{"MAIL_HOST", &c.Mail.Host},
+		{"MAIL_PORT", &c.Mail.Port},
+		{"MAIL_USERNAME", &c.Mail.Username},
+		{"MAIL_PASSWORD", &c.Mail.Password},
+		{"MAIL_FROM", &c.Mail.From},
+		{"TLS_CERT_FILE", &c.TLS.CertFile},
+		{"TLS_KEY_FILE", &c.TLS.KeyFile},
+		{"TLS_AUTOCERT_HOSTS", &c.TLS.AutocertHosts},
+		{"TLS_AUTOCERT_CACHE", &c.TLS.AutocertCache},
+		{"TLS_REDIRECT_PORT", &c.TLS.RedirectPort},
+		{"TLS_HSTS_MAX_AGE", &c.TLS.HSTSMaxAge},
+		{"SERVER_READ_TIMEOUT", &c.Server.ReadTimeout},
+		{"SERVER_WRITE_TIMEOUT", &c.Server.WriteTimeout},
+		{"SERVER_IDLE_TIMEOUT", &c.Server.IdleTimeout},
+		{"SERVER_TRANSFER_TIMEOUT", &c.Server.TransferTimeout},
+		{"SERVER_DRAIN_DELAY", &c.Server.DrainDelay},
+		{"SERVER_SHUTDOWN_TIMEOUT", &c.Server.ShutdownTimeout},
+		{"SERVER_MAX_HEADER_BYTES", &c.Server.MaxHeaderBytes},
+	}
+}
+
+// applyEnv sets the settings of cfg that are in the environment.  Each can
+// also be read from a file named by the variable with fileEnvSuffix, e.g.
+// LENSLOCKED_DB_PASSWORD_FILE, for secrets mounted by Docker or Kubernetes.
+func applyEnv(cfg *Config, lookup func(string) (string, bool)) error {
+	for _, v := range cfg.envVars() {
+		name := envPrefix + v.name
+		value, ok, err := envValue(name, lookup)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		switch dst := v.dst.(type) {
+		case *string:
+			*dst = value
+		case *int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("config: %s must be a number, got %q", name, value)
+			}
+			*dst = n
+		case *[]string:
+			*dst = nil
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					*dst = append(*dst, item)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// envValue returns the value of the environment variable name, reading it
+// from the file named by name with fileEnvSuffix when that is set instead
+func envValue(name string, lookup func(string) (string, bool)) (string, bool, error) {
+	if path, ok := lookup(name + fileEnvSuffix); ok {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", false, fmt.Errorf("config: reading %s: %v", name+fileEnvSuffix, err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), true, nil
+	}
+	value, ok := lookup(name)
+	return value, ok, nil
+}
+
+// defaultSecrets returns the names of the secrets that still have their
+// development defaults
+func (c Config) defaultSecrets() []string {
+	defaults := DefaultConfig()
+	var names []string
+	if c.Pepper == defaults.Pepper {
+		names = append(names, "pepper")
+	}
+	if c.HMACKey == defaults.HMACKey {
+		names = append(names, "hmac_key")
+	}
+	if c.CSRFKey == defaults.CSRFKey {
+		names = append(names, "csrf_key")
 	}
-	fmt.Println("successfully loaded config")
-	return &cfg, nil
+	if c.Database.Password == defaults.Database.Password {
+		names = append(names, "database password")
+	}
+	return names
 }
 
 // Config is responsible for configuring aspects of the applications environment
@@ -96,10 +399,212 @@ type Config struct {
 	Env      string         `json:"env"`
 	Pepper   string         `json:"pepper"`
 	HMACKey  string         `json:"hmac_key"`
+	BaseURL  string         `json:"base_url"`
 	Database DatabaseConfig `json:"database"`
+	Mail     MailConfig     `json:"mail"`
+	TLS      TLSConfig      `json:"tls"`
+	Server   ServerConfig   `json:"server"`
+	Log      LogConfig      `json:"log"`
+	// Admins are the emails of users who are made admins at startup,
+	// after that admins can make other users admins from /admin
+	Admins []string `json:"admins"`
+	// CSRFKey is the base64 encoded 32 byte key that signs csrf cookies,
+	// when it is rotated the old key goes in CSRFPreviousKeys until the
+	// forms opened with it have expired
+	CSRFKey          string   `json:"csrf_key"`
+	CSRFPreviousKeys []string `json:"csrf_previous_keys"`
+	// MetricsToken is the bearer token Prometheus must send to scrape
+	// /metrics, when it is empty anyone can read them
+	MetricsToken string `json:"metrics_token"`
 }
 
 // InProd looks at the config's Env and if it equals "prod"
 func (c Config) InProd() bool {
 	return c.Env == "prod"
 }
+
+const (
+	// minPepperLen and minHMACKeyLen are the shortest secrets accepted in
+	// production
+	minPepperLen  = 16
+	minHMACKeyLen = 32
+	// csrfKeyLen is the size of the keys that sign csrf cookies
+	csrfKeyLen = 32
+	// redacted replaces secrets when the config is printed
+	redacted = "[redacted]"
+)
+
+// ConfigError lists every problem found with a config so they can all be
+// fixed at once
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return fmt.Sprintf("config: %d problem(s):\n  - %s", len(e), strings.Join(e, "\n  - "))
+}
+
+// Validate checks that the config can be used to run the site and returns
+// a ConfigError listing everything that is wrong with it.  In production
+// secrets must be long enough and none may be left at its default.
+func (c Config) Validate() error {
+	var problems ConfigError
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	if !validPort(c.Port) {
+		add("port must be between 1 and 65535, got %d", c.Port)
+	}
+	if c.Env != "dev" && c.Env != "prod" {
+		add("env must be \"dev\" or \"prod\", got %q", c.Env)
+	}
+	if c.Pepper == "" {
+		add("pepper is required")
+	}
+	if c.HMACKey == "" {
+		add("hmac_key is required")
+	}
+	if _, err := decodeCSRFKey(c.CSRFKey); err != nil {
+		add("csrf_key %v", err)
+	}
+	for i, key := range c.CSRFPreviousKeys {
+		if _, err := decodeCSRFKey(key); err != nil {
+			add("csrf_previous_keys[%d] %v", i, err)
+		}
+	}
+	if u, err := url.Parse(c.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		add("base_url must be an absolute http or https url, got %q", c.BaseURL)
+	}
+	if c.Database.Host == "" {
+		add("database.host is required")
+	}
+	if !validPort(c.Database.Port) {
+		add("database.port must be between 1 and 65535, got %d", c.Database.Port)
+	}
+	if c.Database.User == "" {
+		add("database.user is required")
+	}
+	if c.Database.Name == "" {
+		add("database.name is required")
+	}
+	if c.Mail.Host != "" {
+		if !validPort(c.Mail.Port) {
+			add("mail.port must be between 1 and 65535, got %d", c.Mail.Port)
+		}
+		if c.Mail.From == "" {
+			add("mail.from is required when mail.host is set")
+		}
+	}
+	if c.TLS.Enabled() {
+		if c.TLS.Autocert() && (c.TLS.CertFile != "" || c.TLS.KeyFile != "") {
+			add("tls.autocert_hosts cannot be used with tls.cert_file and tls.key_file")
+		}
+		if !c.TLS.Autocert() && (c.TLS.CertFile == "" || c.TLS.KeyFile == "") {
+			add("tls.cert_file and tls.key_file must be set together")
+		}
+		if c.TLS.Autocert() && c.TLS.AutocertCache == "" {
+			add("tls.autocert_cache is required when tls.autocert_hosts is set")
+		}
+		if c.TLS.RedirectPort != 0 && !validPort(c.TLS.RedirectPort) {
+			add("tls.redirect_port must be between 1 and 65535 or 0 for no redirect, got %d", c.TLS.RedirectPort)
+		}
+		if c.TLS.RedirectPort == c.Port {
+			add("tls.redirect_port cannot be the same as port %d", c.Port)
+		}
+		if c.TLS.HSTSMaxAge < 0 {
+			add("tls.hsts_max_age cannot be negative, got %d", c.TLS.HSTSMaxAge)
+		}
+	}
+	if c.Server.ReadTimeout < 0 || c.Server.WriteTimeout < 0 || c.Server.IdleTimeout < 0 {
+		add("server timeouts cannot be negative, got read %d, write %d and idle %d",
+			c.Server.ReadTimeout, c.Server.WriteTimeout, c.Server.IdleTimeout)
+	}
+	if c.Server.TransferTimeout < 0 {
+		add("server.transfer_timeout cannot be negative, got %d", c.Server.TransferTimeout)
+	}
+	if c.Server.DrainDelay < 0 {
+		add("server.drain_delay cannot be negative, got %d", c.Server.DrainDelay)
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		add("server.shutdown_timeout must be at least 1 second, got %d", c.Server.ShutdownTimeout)
+	}
+	if c.Server.MaxHeaderBytes <= 0 {
+		add("server.max_header_bytes must be positive, got %d", c.Server.MaxHeaderBytes)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		add("log.level must be debug, info, warn or error, got %q", c.Log.Level)
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		add("log.format must be \"text\" or \"json\", got %q", c.Log.Format)
+	}
+	for _, address := range c.Admins {
+		if !strings.Contains(address, "@") {
+			add("admins must be email addresses, got %q", address)
+		}
+	}
+	if c.InProd() {
+		if len(c.Pepper) < minPepperLen {
+			add("pepper must be at least %d characters in prod", minPepperLen)
+		}
+		if len(c.HMACKey) < minHMACKeyLen {
+			add("hmac_key must be at least %d characters in prod", minHMACKeyLen)
+		}
+		if c.Mail.Host == "" {
+			add("mail.host is required in prod, emails would be written to the log")
+		}
+		if defaults := c.defaultSecrets(); len(defaults) > 0 {
+			add("refusing to run in prod with the default %s", strings.Join(defaults, ", "))
+		}
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+// Redacted returns a copy of the config with its secrets replaced so it
+// can be printed or logged
+func (c Config) Redacted() Config {
+	for _, secret := range []*string{&c.Pepper, &c.HMACKey, &c.CSRFKey, &c.MetricsToken,
+		&c.Database.Password, &c.Mail.Password} {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	previous := make([]string, len(c.CSRFPreviousKeys))
+	for i := range previous {
+		previous[i] = redacted
+	}
+	c.CSRFPreviousKeys = previous
+	return c
+}
+
+// CSRFKeys returns the decoded csrf keys, the current key first followed
+// by the previous keys still accepted
+func (c Config) CSRFKeys() ([][]byte, error) {
+	var keys [][]byte
+	for _, encoded := range append([]string{c.CSRFKey}, c.CSRFPreviousKeys...) {
+		key, err := decodeCSRFKey(encoded)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// decodeCSRFKey decodes a csrf key, e.g. one made with
+// openssl rand -base64 32
+func decodeCSRFKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("must be base64 encoded")
+	}
+	if len(key) != csrfKeyLen {
+		return nil, fmt.Errorf("must be %d bytes, got %d", csrfKeyLen, len(key))
+	}
+	return key, nil
+}
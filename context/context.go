@@ -2,12 +2,14 @@ package context
 
 import (
 	"context"
+	"log/slog"
 
 	"lenslocked.com/models"
 )
 
 const (
-	userKey privateKey = "user"
+	userKey      privateKey = "user"
+	requestIDKey privateKey = "request_id"
 )
 
 type privateKey string
@@ -24,3 +26,28 @@ func User(ctx context.Context) *models.User {
 	}
 	return nil
 }
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the id of the request being served, it is empty
+// outside of requests
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// Logger returns the default logger with the id of the request and the
+// user making it attached so everything logged while serving a request
+// can be found together
+func Logger(ctx context.Context) *slog.Logger {
+	logger := slog.Default()
+	if id := RequestID(ctx); id != "" {
+		logger = logger.With("request_id", id)
+	}
+	if user := User(ctx); user != nil {
+		logger = logger.With("user_id", user.ID)
+	}
+	return logger
+}
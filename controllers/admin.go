@@ -0,0 +1,253 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+const (
+	NamedAdminUsersRoute     = "admin_users"
+	NamedAdminGalleriesRoute = "admin_galleries"
+	NamedAdminAuditRoute     = "admin_audit"
+)
+
+func NewAdmin(as models.AdminService, audit models.AuditService, us models.UserService,
+	gs models.GalleryService, is models.ImageService, r *mux.Router) *Admin {
+	return &Admin{
+		UsersView:     views.NewView("bootstrap", "admin/users", "admin/nav"),
+		GalleriesView: views.NewView("bootstrap", "admin/galleries", "admin/nav"),
+		AuditView:     views.NewView("bootstrap", "admin/audit", "admin/nav"),
+		as:            as,
+		audit:         audit,
+		us:            us,
+		gs:            gs,
+		is:            is,
+		r:             r,
+	}
+}
+
+// Admin lets admins manage every account and gallery.  Everything it
+// changes is recorded in the audit log.
+type Admin struct {
+	UsersView     *views.View
+	GalleriesView *views.View
+	AuditView     *views.View
+	as            models.AdminService
+	audit         models.AuditService
+	us            models.UserService
+	gs            models.GalleryService
+	is            models.ImageService
+	r             *mux.Router
+}
+
+// adminUsers is what the admin dashboard shows
+type adminUsers struct {
+	Users []models.UserUsage
+	// CurrentID is the admin viewing the page, who cannot disable
+	// themselves
+	CurrentID uint
+	Page      int
+}
+
+// adminGalleries is what the admin galleries page shows
+type adminGalleries struct {
+	Galleries []models.GalleryUsage
+	Page      int
+}
+
+// adminAudit is what the admin audit log page shows
+type adminAudit struct {
+	Filter models.AuditFilter
+	Events []models.AuditEvent
+}
+
+// Users lists every account with how much it stores
+// GET /admin
+func (a *Admin) Users(w http.ResponseWriter, r *http.Request) {
+	page := pageNumber(r)
+	users, total, err := a.as.Users((page-1)*models.AdminPageSize, models.AdminPageSize)
+	if err != nil {
+		logError(r, err)
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	var vd views.Data
+	vd.Yeild = adminUsers{Users: users, CurrentID: viewerID(r), Page: page}
+	vd.Pagination = pagination(r, a.r, NamedAdminUsersRoute, nil, page, total, models.AdminPageSize)
+	a.UsersView.Render(w, r, vd)
+}
+
+// Galleries lists every gallery, largest first
+// GET /admin/galleries
+func (a *Admin) Galleries(w http.ResponseWriter, r *http.Request) {
+	page := pageNumber(r)
+	galleries, total, err := a.as.Galleries((page-1)*models.AdminPageSize, models.AdminPageSize)
+	if err != nil {
+		logError(r, err)
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	var vd views.Data
+	vd.Yeild = adminGalleries{Galleries: galleries, Page: page}
+	vd.Pagination = pagination(r, a.r, NamedAdminGalleriesRoute, nil, page, total, models.AdminPageSize)
+	a.GalleriesView.Render(w, r, vd)
+}
+
+// Audit lists the events in the audit log that match the filter in the
+// query parameters, newest first
+// GET /admin/audit
+func (a *Admin) Audit(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var filter models.AuditFilter
+	if err := parseQuery(r, &filter); err != nil {
+		vd.ErrorAlert(err)
+	}
+	page := pageNumber(r)
+	events, total, err := a.audit.Query(filter, (page-1)*models.AuditPageSize, models.AuditPageSize)
+	if err != nil {
+		logError(r, err)
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	vd.Yeild = adminAudit{Filter: filter, Events: events}
+	vd.Pagination = pagination(r, a.r, NamedAdminAuditRoute, nil, page, total, models.AuditPageSize)
+	keepQuery(vd.Pagination, r)
+	a.AuditView.Render(w, r, vd)
+}
+
+// DisableUser stops a user from logging in and logs them out
+// POST /admin/users/:id/disable
+func (a *Admin) DisableUser(w http.ResponseWriter, r *http.Request) {
+	a.updateUser(w, r, models.AdminDisableUser, true, func(user *models.User) {
+		user.Disabled = true
+	})
+}
+
+// EnableUser lets a disabled user log in again
+// POST /admin/users/:id/enable
+func (a *Admin) EnableUser(w http.ResponseWriter, r *http.Request) {
+	a.updateUser(w, r, models.AdminEnableUser, false, func(user *models.User) {
+		user.Disabled = false
+	})
+}
+
+// ResetPassword logs a user out and makes them choose a new password the
+// next time they log in
+// POST /admin/users/:id/reset-password
+func (a *Admin) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	a.updateUser(w, r, models.AdminResetPassword, true, func(user *models.User) {
+		user.PasswordResetRequired = true
+	})
+}
+
+// GrantAdmin makes a user an admin
+// POST /admin/users/:id/grant
+func (a *Admin) GrantAdmin(w http.ResponseWriter, r *http.Request) {
+	a.updateUser(w, r, models.AdminGrantAdmin, false, func(user *models.User) {
+		user.Admin = true
+	})
+}
+
+// RevokeAdmin stops a user from being an admin
+// POST /admin/users/:id/revoke
+func (a *Admin) RevokeAdmin(w http.ResponseWriter, r *http.Request) {
+	a.updateUser(w, r, models.AdminRevokeAdmin, false, func(user *models.User) {
+		user.Admin = false
+	})
+}
+
+// RemoveGallery deletes an abusive gallery along with its images so they
+// can no longer be served
+// POST /admin/galleries/:id/delete
+func (a *Admin) RemoveGallery(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid gallery ID", http.StatusNotFound)
+		return
+	}
+	gallery, err := a.gs.ByID(uint(id))
+	if err != nil {
+		a.adminError(w, r, err)
+		return
+	}
+	images, err := a.is.ByGalleryID(gallery.ID)
+	if err != nil {
+		a.adminError(w, r, err)
+		return
+	}
+	is := a.is.As(actor(r))
+	for i := range images {
+		if err := is.Delete(&images[i]); err != nil {
+			a.adminError(w, r, err)
+			return
+		}
+	}
+	if err := a.gs.As(actor(r)).Delete(gallery.ID); err != nil {
+		a.adminError(w, r, err)
+		return
+	}
+	a.record(r, models.AdminRemoveGallery, models.TargetGallery, gallery.ID,
+		map[string]interface{}{"title": gallery.Title, "owner_id": gallery.UserID, "images": len(images)})
+	a.redirect(w, r, NamedAdminGalleriesRoute)
+}
+
+// updateUser applies change to the user in the url and records action in
+// the audit log, with logOut the cookies the user is logged in with stop
+// working too.  Admins cannot change their own account so they cannot
+// lock themselves out.
+func (a *Admin) updateUser(w http.ResponseWriter, r *http.Request, action string, logOut bool, change func(*models.User)) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusNotFound)
+		return
+	}
+	if uint(id) == viewerID(r) {
+		http.Error(w, "You cannot change your own account here", http.StatusBadRequest)
+		return
+	}
+	user, err := a.us.ByID(uint(id))
+	if err == nil {
+		change(user)
+		us := a.us.As(actor(r))
+		if logOut {
+			// logging out saves the change along with the new token
+			err = us.LogOut(user)
+		} else {
+			err = us.Update(user)
+		}
+	}
+	if err != nil {
+		a.adminError(w, r, err)
+		return
+	}
+	a.record(r, action, models.TargetUser, user.ID, map[string]interface{}{"email": user.Email})
+	a.redirect(w, r, NamedAdminUsersRoute)
+}
+
+// record adds what the current admin did to the audit log, the action has
+// already been taken so failing to record it is only logged
+func (a *Admin) record(r *http.Request, action, targetType string, targetID uint, details map[string]interface{}) {
+	if err := a.audit.Record(actor(r), action, targetType, targetID, details); err != nil {
+		logError(r, fmt.Errorf("admin: could not record %s of %s %d: %v", action, targetType, targetID, err))
+	}
+}
+
+// redirect sends the admin back to the page of the named list they came
+// from
+func (a *Admin) redirect(w http.ResponseWriter, r *http.Request, route string) {
+	http.Redirect(w, r, pageURL(r, a.r, route, nil, "page", fmt.Sprintf("%d", pageNumber(r))), http.StatusFound)
+}
+
+func (a *Admin) adminError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == models.ErrNotFound {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	logError(r, err)
+	http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+}
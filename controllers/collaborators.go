@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/policy"
+	"lenslocked.com/views"
+)
+
+type CollaboratorForm struct {
+	Email string `schema:"email"`
+	Role  string `schema:"role"`
+}
+
+// invitation is what is shown to a user who follows an invitation link
+type invitation struct {
+	Token   string
+	Gallery *models.Gallery
+	Role    string
+}
+
+// InviteCollaborator shares the gallery with someone by email, inviting
+// an email that was already invited changes their role
+// POST /galleries/:id/collaborators
+func (g *Galleries) InviteCollaborator(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.authorize(w, r, gallery, policy.ManageGallery) {
+		return
+	}
+	vd := g.galleryData(r, gallery, NamedGalleryEditRoute)
+	var form CollaboratorForm
+	if err := parseForm(r, &form); err != nil {
+		logError(r, err)
+		vd.ErrorAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	collaborator := models.Collaborator{
+		GalleryID: gallery.ID,
+		Email:     form.Email,
+		Role:      form.Role,
+	}
+	if err := g.collabs.Invite(&collaborator); err != nil {
+		vd.ErrorAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	vd = g.galleryData(r, gallery, NamedGalleryEditRoute)
+	if collaborator.Token != "" {
+		if err := g.sendInvitation(r, gallery, &collaborator); err != nil {
+			logError(r, err)
+			vd.Alert = &views.Alert{
+				Level:   views.AlertLvlWarning,
+				Message: "The invitation was saved but the email could not be sent, please try again later.",
+			}
+			g.EditView.Render(w, r, vd)
+			return
+		}
+		vd.SuccessAlert("An invitation was sent to " + collaborator.Email)
+	} else {
+		vd.SuccessAlert(collaborator.Email + " is now a " + collaborator.Role)
+	}
+	g.EditView.Render(w, r, vd)
+}
+
+// sendInvitation emails the collaborator a link to accept the invitation
+func (g *Galleries) sendInvitation(r *http.Request, gallery *models.Gallery, collaborator *models.Collaborator) error {
+	user := context.User(r.Context())
+	subject := fmt.Sprintf("%s shared %q with you", user.Name, gallery.Title)
+	body := fmt.Sprintf("%s invited you to be a %s of the gallery %q.\n\n"+
+		"Log in or sign up with this email address and follow this link to accept:\n%s/invitations/%s\n",
+		user.Name, collaborator.Role, gallery.Title, g.baseURL, collaborator.Token)
+	return g.mailer.Send(collaborator.Email, subject, body)
+}
+
+// RemoveCollaborator stops sharing the gallery with a collaborator, it
+// also cancels pending invitations
+// POST /galleries/:id/collaborators/:collaborator_id/delete
+func (g *Galleries) RemoveCollaborator(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.authorize(w, r, gallery, policy.ManageGallery) {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["collaborator_id"])
+	if err != nil {
+		http.Error(w, "Invalid collaborator ID", http.StatusNotFound)
+		return
+	}
+	collaborator, err := g.collabs.ByID(uint(id))
+	if err == nil && collaborator.GalleryID != gallery.ID {
+		err = models.ErrNotFound
+	}
+	if err == nil {
+		err = g.collabs.Delete(collaborator.ID)
+	}
+	if err != nil {
+		vd := g.galleryData(r, gallery, NamedGalleryEditRoute)
+		vd.ErrorAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery)
+}
+
+// ShowInvitation asks the current user to accept an invitation
+// GET /invitations/:token
+func (g *Galleries) ShowInvitation(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	collaborator, err := g.collabs.ByToken(token)
+	if err != nil {
+		http.Error(w, "Invitation not found", http.StatusNotFound)
+		return
+	}
+	gallery, err := g.gs.ByID(collaborator.GalleryID)
+	if err != nil {
+		http.Error(w, "Invitation not found", http.StatusNotFound)
+		return
+	}
+	var vd views.Data
+	vd.Yeild = invitation{Token: token, Gallery: gallery, Role: collaborator.Role}
+	if user := context.User(r.Context()); user.Email != collaborator.Email {
+		vd.Alert = &views.Alert{
+			Level:   views.AlertLvlWarning,
+			Message: "This invitation was sent to a different email address than the one you are logged in with.",
+		}
+	}
+	g.InvitationView.Render(w, r, vd)
+}
+
+// AcceptInvitation gives the current user access to the gallery they were
+// invited to
+// POST /invitations/:token
+func (g *Galleries) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	collaborator, err := g.collabs.Accept(mux.Vars(r)["token"], user)
+	if err != nil {
+		if err == models.ErrNotFound {
+			http.Error(w, "Invitation not found", http.StatusNotFound)
+			return
+		}
+		var vd views.Data
+		vd.ErrorAlert(err)
+		g.InvitationView.Render(w, r, vd)
+		return
+	}
+	url, err := g.r.Get(NamedGalleryShowRoute).URL("id", fmt.Sprintf("%v", collaborator.GalleryID))
+	if err != nil {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
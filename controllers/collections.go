@@ -0,0 +1,308 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/policy"
+	"lenslocked.com/views"
+)
+
+const (
+	NamedCollectionShowRoute = "collections_show"
+	NamedCollectionEditRoute = "collections_edit"
+)
+
+func NewCollections(cs models.CollectionService, gs models.GalleryService, is models.ImageService,
+	p *policy.Policy, r *mux.Router) *Collections {
+	return &Collections{
+		NewView:  views.NewView("bootstrap", "collections/new"),
+		ShowView: views.NewView("bootstrap", "collections/show", "collections/contents"),
+		EditView: views.NewView("bootstrap", "collections/edit", "collections/contents"),
+		cs:       cs,
+		gs:       gs,
+		is:       is,
+		policy:   p,
+		r:        r,
+	}
+}
+
+type Collections struct {
+	NewView  *views.View
+	ShowView *views.View
+	EditView *views.View
+	cs       models.CollectionService
+	gs       models.GalleryService
+	is       models.ImageService
+	policy   *policy.Policy
+	r        *mux.Router
+}
+
+// CollectionForm contains the title of a collection and the collection
+// it is nested in
+type CollectionForm struct {
+	Title    string `schema:"title"`
+	ParentID uint   `schema:"parent_id"`
+}
+
+// GET /collections/new
+func (c *Collections) New(w http.ResponseWriter, r *http.Request) {
+	var collection models.Collection
+	parentID, _ := strconv.ParseUint(r.URL.Query().Get("parent"), 10, 64)
+	collection.ParentID = uint(parentID)
+	var vd views.Data
+	vd.Yeild = &collection
+	c.NewView.Render(w, r, vd)
+}
+
+// POST /collections
+func (c *Collections) Create(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var collection models.Collection
+	vd.Yeild = &collection
+	var form CollectionForm
+	if err := parseForm(r, &form); err != nil {
+		logError(r, err)
+		vd.ErrorAlert(err)
+		c.NewView.Render(w, r, vd)
+		return
+	}
+	user := context.User(r.Context())
+	collection.Title = form.Title
+	collection.ParentID = form.ParentID
+	collection.UserID = user.ID
+	if err := c.cs.Create(&collection); err != nil {
+		vd.ErrorAlert(err)
+		c.NewView.Render(w, r, vd)
+		return
+	}
+	c.redirectToEdit(w, r, &collection)
+}
+
+// GET /collections/:id
+func (c *Collections) Show(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.collectionByID(w, r)
+	if err != nil {
+		return
+	}
+	if err := c.loadContents(collection, viewerID(r)); err != nil {
+		logError(r, err)
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	viewer := viewerID(r)
+	visible := collection.Galleries[:0]
+	for _, gallery := range collection.Galleries {
+		if gallery.VisibleTo(viewer) {
+			visible = append(visible, gallery)
+		}
+	}
+	collection.Galleries = visible
+	vd := c.collectionData(r, collection)
+	c.ShowView.Render(w, r, vd)
+}
+
+// GET /collections/:id/edit
+func (c *Collections) Edit(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.collectionByID(w, r)
+	if err != nil {
+		return
+	}
+	if !c.authorize(w, r, collection, policy.EditCollection) {
+		return
+	}
+	if err := c.loadEditData(collection, viewerID(r)); err != nil {
+		logError(r, err)
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	vd := c.collectionData(r, collection)
+	c.EditView.Render(w, r, vd)
+}
+
+// Update renames a collection and moves it into another collection
+// POST /collections/:id/update
+func (c *Collections) Update(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.collectionByID(w, r)
+	if err != nil {
+		return
+	}
+	if !c.authorize(w, r, collection, policy.EditCollection) {
+		return
+	}
+	if err := c.loadEditData(collection, viewerID(r)); err != nil {
+		logError(r, err)
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	vd := c.collectionData(r, collection)
+	var form CollectionForm
+	if err := parseForm(r, &form); err != nil {
+		logError(r, err)
+		vd.ErrorAlert(err)
+		c.EditView.Render(w, r, vd)
+		return
+	}
+	collection.Title = form.Title
+	collection.ParentID = form.ParentID
+	if err := c.cs.Update(collection); err != nil {
+		vd.ErrorAlert(err)
+		c.EditView.Render(w, r, vd)
+		return
+	}
+	c.redirectToEdit(w, r, collection)
+}
+
+// Delete removes a collection, its galleries and collections are moved up
+// into the collection it was in
+// POST /collections/:id/delete
+func (c *Collections) Delete(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.collectionByID(w, r)
+	if err != nil {
+		return
+	}
+	if !c.authorize(w, r, collection, policy.EditCollection) {
+		return
+	}
+	if err := c.cs.Delete(collection.ID); err != nil {
+		var vd views.Data
+		vd.Yeild = collection
+		vd.ErrorAlert(err)
+		c.EditView.Render(w, r, vd)
+		return
+	}
+	if collection.ParentID == 0 {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	url, err := c.r.Get(NamedCollectionShowRoute).URL("id", fmt.Sprintf("%v", collection.ParentID))
+	if err != nil {
+		logError(r, err)
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
+
+// loadContents fills in the collections in a collection and the galleries
+// in it the user with viewerID can see
+func (c *Collections) loadContents(collection *models.Collection, viewerID uint) error {
+	children, err := c.cs.ByParentID(collection.UserID, collection.ID)
+	if err != nil {
+		return err
+	}
+	galleries, err := c.gs.ByCollectionID(collection.ID, viewerID)
+	if err != nil {
+		return err
+	}
+	if err := c.is.Summarize(galleries); err != nil {
+		return err
+	}
+	collection.Collections = children
+	collection.Galleries = galleries
+	return nil
+}
+
+// loadEditData fills in a collection's contents along with the other
+// collections it could be moved into
+func (c *Collections) loadEditData(collection *models.Collection, viewerID uint) error {
+	if err := c.loadContents(collection, viewerID); err != nil {
+		return err
+	}
+	all, err := c.cs.ByUserID(collection.UserID)
+	if err != nil {
+		return err
+	}
+	for _, option := range all {
+		if option.ID != collection.ID {
+			collection.ParentOptions = append(collection.ParentOptions, option)
+		}
+	}
+	return nil
+}
+
+// collectionData returns the view data for a collection along with the
+// trail of collections it is nested in
+func (c *Collections) collectionData(r *http.Request, collection *models.Collection) views.Data {
+	vd := views.Data{Yeild: collection}
+	path, err := c.cs.Path(collection.ParentID)
+	if err != nil {
+		context.Logger(r.Context()).Error("loading collection path", "collection_id", collection.ID, "error", err)
+	}
+	vd.Breadcrumbs = append(breadcrumbs(r, c.r, path), views.Breadcrumb{Name: collection.Title})
+	return vd
+}
+
+func (c *Collections) redirectToEdit(w http.ResponseWriter, r *http.Request, collection *models.Collection) {
+	url, err := c.r.Get(NamedCollectionEditRoute).URL("id", fmt.Sprintf("%v", collection.ID))
+	if err != nil {
+		logError(r, err)
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
+
+// collectionByID gets gorilla mux url variables out and returns the collection
+// with that ID.  If one does not exist it will return nil and an error
+func (c *Collections) collectionByID(w http.ResponseWriter, r *http.Request) (*models.Collection, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logError(r, err)
+		http.Error(w, "Invalid collection ID", http.StatusNotFound)
+		return nil, err
+	}
+	collection, err := c.cs.ByID(uint(id))
+	switch err {
+	case models.ErrNotFound:
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return nil, err
+	case nil:
+		break
+	default:
+		logError(r, err)
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return nil, err
+	}
+	if !c.authorize(w, r, collection, policy.ViewCollection) {
+		return nil, models.ErrNotFound
+	}
+	return collection, nil
+}
+
+// authorize checks that the policy lets the current user take action on
+// the collection and responds as if it does not exist when it does not
+func (c *Collections) authorize(w http.ResponseWriter, r *http.Request, collection *models.Collection, action policy.Action) bool {
+	allowed, err := c.policy.Can(context.User(r.Context()), action, collection)
+	if err != nil {
+		logError(r, err)
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return false
+	}
+	if !allowed {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// breadcrumbs builds the trail from the galleries index through each of
+// the collections in path
+func breadcrumbs(r *http.Request, router *mux.Router, path []models.Collection) []views.Breadcrumb {
+	crumbs := []views.Breadcrumb{{Name: "Galleries", URL: "/galleries"}}
+	for _, collection := range path {
+		crumb := views.Breadcrumb{Name: collection.Title}
+		url, err := router.Get(NamedCollectionShowRoute).URL("id", fmt.Sprintf("%v", collection.ID))
+		if err != nil {
+			context.Logger(r.Context()).Error("building breadcrumb url", "error", err)
+		} else {
+			crumb.URL = url.Path
+		}
+		crumbs = append(crumbs, crumb)
+	}
+	return crumbs
+}
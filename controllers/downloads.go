@@ -0,0 +1,188 @@
+package controllers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+
+	"lenslocked.com/models"
+)
+
+const (
+	// NamedGalleryDownloadRoute is the route used to download a whole gallery
+	NamedGalleryDownloadRoute = "galleries_download"
+	// manifestFilename is the name of the manifest inside gallery archives
+	manifestFilename = "manifest.json"
+)
+
+// manifest describes the contents of a gallery archive
+type manifest struct {
+	GalleryID   uint            `json:"gallery_id"`
+	Title       string          `json:"title"`
+	Rendition   string          `json:"rendition"`
+	GeneratedAt time.Time       `json:"generated_at"`
+	Images      []manifestImage `json:"images"`
+}
+
+type manifestImage struct {
+	Path     string `json:"path"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Caption  string `json:"caption,omitempty"`
+	AltText  string `json:"alt_text,omitempty"`
+}
+
+// Download streams a ZIP archive of every image in the gallery straight
+// to the response along with a manifest of what it contains.  The
+// rendition query parameter picks which version of the images is used,
+// originals may contain a location so only the owner can download them.
+// GET /galleries/:id/download
+func (g *Galleries) Download(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	// the archive has every image not just the page galleryByID loaded
+	gallery.Images, err = g.is.ByGallery(gallery)
+	if err != nil {
+		logError(r, err)
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	owner := viewerID(r) == gallery.UserID
+	rendition := r.URL.Query().Get("rendition")
+	switch {
+	case rendition == "" && owner:
+		rendition = models.RenditionOriginal
+	case rendition == "":
+		rendition = models.RenditionWeb
+	case rendition == models.RenditionOriginal && !owner:
+		http.Error(w, "Originals can only be downloaded by the gallery owner", http.StatusForbidden)
+		return
+	case rendition != models.RenditionOriginal && rendition != models.RenditionWeb:
+		http.Error(w, "Invalid rendition", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": archiveName(gallery),
+	}))
+	zw := zip.NewWriter(w)
+	m := manifest{
+		GalleryID:   gallery.ID,
+		Title:       gallery.Title,
+		Rendition:   rendition,
+		GeneratedAt: time.Now().UTC(),
+	}
+	used := make(map[string]bool, len(gallery.Images))
+	for i := range gallery.Images {
+		img := &gallery.Images[i]
+		name := uniqueName(used, img.Filename)
+		n, err := g.writeArchiveImage(zw, img, name, rendition)
+		if err != nil {
+			// the response has already started so the best we can do is
+			// stop writing and leave the client with an incomplete archive
+			logError(r, err)
+			return
+		}
+		entry := manifestImage{
+			Path:     name,
+			Filename: img.Filename,
+			Size:     n,
+			Title:    img.Title,
+			Caption:  img.Caption,
+			AltText:  img.AltText,
+		}
+		if rendition == models.RenditionOriginal {
+			// checksums are taken of what was uploaded
+			entry.SHA256 = img.Checksum
+		}
+		m.Images = append(m.Images, entry)
+	}
+	mw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     manifestFilename,
+		Method:   zip.Deflate,
+		Modified: m.GeneratedAt,
+	})
+	if err != nil {
+		logError(r, err)
+		return
+	}
+	enc := json.NewEncoder(mw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(m); err != nil {
+		logError(r, err)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		logError(r, err)
+	}
+}
+
+// writeArchiveImage copies an image into the archive under name and returns
+// the number of bytes written.  Images are stored rather than deflated as
+// jpgs and pngs are already compressed.
+func (g *Galleries) writeArchiveImage(zw *zip.Writer, img *models.Image, name, rendition string) (int64, error) {
+	f, err := g.is.Open(img, rendition)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	dst, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: img.UpdatedAt,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(dst, f)
+}
+
+// archiveName turns a gallery title into a filename that is safe to
+// suggest to browsers e.g. "Smith Wedding!" becomes "smith-wedding.zip"
+func archiveName(gallery *models.Gallery) string {
+	var b strings.Builder
+	dash := false
+	for _, c := range strings.ToLower(gallery.Title) {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			b.WriteRune(c)
+			dash = false
+			continue
+		}
+		if !dash && b.Len() > 0 {
+			b.WriteRune('-')
+			dash = true
+		}
+	}
+	name := strings.TrimSuffix(b.String(), "-")
+	if name == "" {
+		name = fmt.Sprintf("gallery-%d", gallery.ID)
+	}
+	return name + ".zip"
+}
+
+// uniqueName returns filename or, if it has already been used in the
+// archive, filename with a number appended before its extension
+func uniqueName(used map[string]bool, filename string) string {
+	name := path.Base(strings.ReplaceAll(filename, "\\", "/"))
+	if name == manifestFilename {
+		name = "image-" + name
+	}
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 2; used[name]; i++ {
+		name = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	used[name] = true
+	return name
+}
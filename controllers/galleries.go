@@ -2,60 +2,150 @@ package controllers
 
 import (
 	"fmt"
-	"log"
+	"mime/multipart"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"lenslocked.com/context"
+	"lenslocked.com/email"
 	"lenslocked.com/models"
+	"lenslocked.com/policy"
 	"lenslocked.com/views"
 )
 
-
 const (
-	NamedGalleryShowRoute = "galleries_show"
-	NamedGalleryEditRoute = "galleries_edit"
-	maxMultipartMem       = 1 << 20 //1 megabyte
+	NamedGalleryIndexRoute = "galleries_index"
+	NamedGalleryShowRoute  = "galleries_show"
+	NamedGalleryEditRoute  = "galleries_edit"
+	maxMultipartMem        = 1 << 20 //1 megabyte
+	maxZipUploadSize       = 4 << 30 //4 gigabytes
 )
 
-func NewGalleries(gs models.GalleryService, is models.ImageService, r *mux.Router) *Galleries {
+// NewGalleries creates the galleries controller.  Invitations to
+// collaborate are sent with mailer and link to baseURL.
+func NewGalleries(gs models.GalleryService, is models.ImageService, us models.UploadService,
+	cs models.CollectionService, collabs models.CollaboratorService,
+	mailer email.Mailer, baseURL string, p *policy.Policy, r *mux.Router) *Galleries {
 	return &Galleries{
-		New:       views.NewView("bootstrap", "galleries/new"),
-		ShowView:  views.NewView("bootstrap", "galleries/show"),
-		EditView:  views.NewView("bootstrap", "galleries/edit"),
-		IndexView: views.NewView("bootstrap", "galleries/index"),
-		gs:        gs,
-		is:        is,
-		r:         r,
+		New:            views.NewView("bootstrap", "galleries/new"),
+		ShowView:       views.NewView("bootstrap", "galleries/show"),
+		EditView:       views.NewView("bootstrap", "galleries/edit"),
+		IndexView:      views.NewView("bootstrap", "galleries/index"),
+		InvitationView: views.NewView("bootstrap", "galleries/invitation"),
+		gs:             gs,
+		is:             is,
+		us:             us,
+		cs:             cs,
+		collabs:        collabs,
+		mailer:         mailer,
+		baseURL:        strings.TrimSuffix(baseURL, "/"),
+		policy:         p,
+		r:              r,
 	}
 }
 
 type Galleries struct {
-	New       *views.View
-	ShowView  *views.View
-	EditView  *views.View
-	IndexView *views.View
-	gs        models.GalleryService
-	is        models.ImageService
-	r         *mux.Router
+	New            *views.View
+	ShowView       *views.View
+	EditView       *views.View
+	IndexView      *views.View
+	InvitationView *views.View
+	gs             models.GalleryService
+	is             models.ImageService
+	us             models.UploadService
+	cs             models.CollectionService
+	collabs        models.CollaboratorService
+	mailer         email.Mailer
+	baseURL        string
+	policy         *policy.Policy
+	r              *mux.Router
 }
 
 type GalleryForm struct {
-	Title string `schema:"title"`
+	Title    string `schema:"title"`
+	KeepGPS  bool   `schema:"keep_gps"`
+	Private  bool   `schema:"private"`
+	SortMode string `schema:"sort_mode"`
+	// Tags is a comma separated list of tags
+	Tags string `schema:"tags"`
+}
+
+// ImageForm contains the text that can be edited for an image
+type ImageForm struct {
+	Title   string `schema:"title"`
+	Caption string `schema:"caption"`
+	AltText string `schema:"alt_text"`
+	// Tags is a comma separated list of tags
+	Tags string `schema:"tags"`
+}
+
+// CoverForm contains the filename of the image chosen as a gallery's cover
+type CoverForm struct {
+	Filename string `schema:"filename"`
+}
+
+// MoveForm contains the collection a gallery is moved into, 0 takes it
+// out of every collection
+type MoveForm struct {
+	CollectionID uint `schema:"collection_id"`
+}
+
+// galleryIndex is what the galleries index page lists
+type galleryIndex struct {
+	Collections []models.Collection
+	Galleries   []models.Gallery
+	// Shared are the galleries other users have shared with the user
+	Shared []models.Gallery
+}
+
+// ReorderForm lists the filenames of a gallery's images in their new order
+type ReorderForm struct {
+	Filenames []string `schema:"filenames"`
 }
 
 // GET /galleries
 func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	user := context.User(r.Context())
-	galleries, err := g.gs.ByUserID(user.ID)
+	cursor, _ := strconv.ParseUint(r.URL.Query().Get("cursor"), 10, 64)
+	galleries, next, err := g.gs.ByUserID(user.ID, models.GalleryPageSize, uint(cursor))
+	if err != nil {
+		logError(r, err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	if err := g.is.Summarize(galleries); err != nil {
+		logError(r, err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	collections, err := g.cs.ByParentID(user.ID, 0)
+	if err != nil {
+		logError(r, err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	shared, err := g.collabs.SharedWith(user.ID)
+	if err == nil {
+		err = g.is.Summarize(shared)
+	}
 	if err != nil {
-		log.Print(err)
+		logError(r, err)
 		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
 		return
 	}
 	var vd views.Data
-	vd.Yeild = galleries
+	vd.Yeild = galleryIndex{Collections: collections, Galleries: galleries, Shared: shared}
+	if cursor != 0 || next != 0 {
+		vd.Pagination = &views.Pagination{}
+		if cursor != 0 {
+			vd.Pagination.First = pageURL(r, g.r, NamedGalleryIndexRoute, nil, "", "")
+		}
+		if next != 0 {
+			vd.Pagination.Next = pageURL(r, g.r, NamedGalleryIndexRoute, nil, "cursor", strconv.Itoa(int(next)))
+		}
+	}
 	g.IndexView.Render(w, r, vd)
 }
 
@@ -65,8 +155,7 @@ func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	var vd views.Data
-	vd.Yeild = gallery
+	vd := g.galleryData(r, gallery, NamedGalleryShowRoute)
 	g.ShowView.Render(w, r, vd)
 }
 
@@ -76,42 +165,65 @@ func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if !g.authorize(w, r, gallery, policy.UploadImages) {
 		return
 	}
-	var vd views.Data
-	vd.Yeild = gallery
+	vd := g.galleryData(r, gallery, NamedGalleryEditRoute)
 	g.EditView.Render(w, r, vd)
 }
 
-// GET /galleries/:id/edit
+// POST /galleries/:id/update
 func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r)
 	if err != nil {
 		return
 	}
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if !g.authorize(w, r, gallery, policy.EditGallery) {
 		return
 	}
-	var vd views.Data
-	vd.Yeild = gallery
+	vd := g.galleryData(r, gallery, NamedGalleryEditRoute)
 	var form GalleryForm
 	if err := parseForm(r, &form); err != nil {
-		log.Println(err)
+		logError(r, err)
 		vd.ErrorAlert(err)
 		g.EditView.Render(w, r, vd)
 		return
 	}
+	manage, err := g.policy.Can(context.User(r.Context()), policy.ManageGallery, gallery)
+	if err != nil {
+		logError(r, err)
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return
+	}
 	gallery.Title = form.Title
-	if err := g.gs.Update(gallery); err != nil {
+	// who can see the gallery, its locations and the order of its images
+	// are up to the owner, the stored settings are kept when an editor
+	// saves the form
+	gpsChanged := manage && gallery.KeepGPS != form.KeepGPS
+	if manage {
+		gallery.KeepGPS = form.KeepGPS
+		gallery.Private = form.Private
+		gallery.SortMode = form.SortMode
+	}
+	if err := g.gs.As(actor(r)).Update(gallery); err != nil {
+		vd.ErrorAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	gallery.Tags = models.ParseTags(form.Tags)
+	if err := g.gs.SetTags(gallery); err != nil {
 		vd.ErrorAlert(err)
 		g.EditView.Render(w, r, vd)
 		return
 	}
+	if gpsChanged {
+		if err := g.is.Rerender(r.Context(), gallery.ID); err != nil {
+			logError(r, err)
+			vd.ErrorAlert(err)
+			g.EditView.Render(w, r, vd)
+			return
+		}
+	}
 	vd.SuccessAlert("Gallery successfully updated!")
 	g.EditView.Render(w, r, vd)
 }
@@ -122,54 +234,254 @@ func (g *Galleries) UploadImages(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if !g.authorize(w, r, gallery, policy.UploadImages) {
 		return
 	}
-	var vd views.Data
-	vd.Yeild = gallery
+	vd := g.galleryData(r, gallery, NamedGalleryEditRoute)
 	err = r.ParseMultipartForm(maxMultipartMem)
 	if err != nil {
 		vd.ErrorAlert(err)
 		g.EditView.Render(w, r, vd)
 		return
 	}
-	// nonFileNames := make([]string, 0)
+	// a failing file should not stop the rest of the batch from uploading
+	var failed []string
 	files := r.MultipartForm.File["images"]
 	for _, f := range files {
-		file, ferr := f.Open()
-		if ferr != nil {
-			vd.ErrorAlert(ferr)
-			g.EditView.Render(w, r, vd)
-			return
+		if err := g.uploadImage(r, gallery, f); err != nil {
+			logError(r, err)
+			failed = append(failed, f.Filename)
+		}
+	}
+	if len(failed) > 0 {
+		if err := g.loadImages(r, gallery); err != nil {
+			logError(r, err)
+		}
+		vd = g.galleryData(r, gallery, NamedGalleryEditRoute)
+		vd.Alert = &views.Alert{
+			Level: views.AlertLvlWarning,
+			Message: fmt.Sprintf("%d of %d images could not be uploaded: %s",
+				len(failed), len(files), strings.Join(failed, ", ")),
 		}
-		// if invalidExension(f.Filename) {
-		// 	nonFileNames = append(nonFileNames, f.Filename)
-		// 	continue
-		// }
-		img := &models.Image{
-			GalleryID: gallery.ID,
-			Filename:  f.Filename,
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery)
+}
+
+// uploadImage saves a single file from a multipart form to the gallery
+func (g *Galleries) uploadImage(r *http.Request, gallery *models.Gallery, fh *multipart.FileHeader) error {
+	file, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	img := &models.Image{
+		GalleryID: gallery.ID,
+		Filename:  fh.Filename,
+	}
+	return g.is.As(actor(r)).Create(r.Context(), img, file)
+}
+
+// ImportZip extracts every image in an uploaded zip archive into the gallery
+// POST /galleries/:id/images/zip
+func (g *Galleries) ImportZip(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.authorize(w, r, gallery, policy.UploadImages) {
+		return
+	}
+	vd := g.galleryData(r, gallery, NamedGalleryEditRoute)
+	r.Body = http.MaxBytesReader(w, r.Body, maxZipUploadSize)
+	if err := r.ParseMultipartForm(maxMultipartMem); err != nil {
+		logError(r, err)
+		vd.ErrorAlert(models.ErrZipTooLarge)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	file, fh, err := r.FormFile("archive")
+	if err != nil {
+		vd.ErrorAlert(models.ErrZipInvalid)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	defer file.Close()
+	result, err := g.is.As(actor(r)).ImportZip(r.Context(), gallery.ID, file, fh.Size)
+	if loadErr := g.loadImages(r, gallery); loadErr != nil {
+		logError(r, loadErr)
+	}
+	vd = g.galleryData(r, gallery, NamedGalleryEditRoute)
+	if err != nil {
+		logError(r, err)
+		vd.ErrorAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	if len(result.Skipped) > 0 {
+		skipped := make([]string, len(result.Skipped))
+		for i, s := range result.Skipped {
+			skipped[i] = fmt.Sprintf("%s (%s)", s.Name, s.Reason)
+		}
+		vd.Alert = &views.Alert{
+			Level: views.AlertLvlWarning,
+			Message: fmt.Sprintf("Imported %d images. Skipped: %s",
+				len(result.Images), strings.Join(skipped, ", ")),
+		}
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	vd.SuccessAlert(fmt.Sprintf("Imported %d images!", len(result.Images)))
+	g.EditView.Render(w, r, vd)
+}
+
+// UpdateImage saves the title, caption and alt text of an image
+// POST /galleries/:id/images/:filename/update
+func (g *Galleries) UpdateImage(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.authorize(w, r, gallery, policy.EditGallery) {
+		return
+	}
+	img, err := g.is.ByFilename(gallery.ID, mux.Vars(r)["filename"])
+	switch err {
+	case models.ErrNotFound:
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	case nil:
+		break
+	default:
+		logError(r, err)
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	vd := g.galleryData(r, gallery, NamedGalleryEditRoute)
+	var form ImageForm
+	if err := parseForm(r, &form); err != nil {
+		logError(r, err)
+		vd.ErrorAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	img.Title = form.Title
+	img.Caption = form.Caption
+	img.AltText = form.AltText
+	if err := g.is.Update(img); err != nil {
+		vd.ErrorAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	img.Tags = models.ParseTags(form.Tags)
+	if err := g.is.SetTags(img); err != nil {
+		vd.ErrorAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery)
+}
+
+// SetCover chooses the image that represents the gallery in listings
+// POST /galleries/:id/cover
+func (g *Galleries) SetCover(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.authorize(w, r, gallery, policy.EditGallery) {
+		return
+	}
+	vd := g.galleryData(r, gallery, NamedGalleryEditRoute)
+	var form CoverForm
+	if err := parseForm(r, &form); err != nil {
+		logError(r, err)
+		vd.ErrorAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	img, err := g.is.ByFilename(gallery.ID, form.Filename)
+	if err != nil {
+		vd.ErrorAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	gallery.CoverImageID = img.ID
+	if err := g.gs.As(actor(r)).Update(gallery); err != nil {
+		vd.ErrorAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery)
+}
+
+// ReorderImages sets the custom order of the gallery's images
+// POST /galleries/:id/images/order
+func (g *Galleries) ReorderImages(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.authorize(w, r, gallery, policy.EditGallery) {
+		return
+	}
+	vd := g.galleryData(r, gallery, NamedGalleryEditRoute)
+	var form ReorderForm
+	if err := parseForm(r, &form); err != nil {
+		logError(r, err)
+		vd.ErrorAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	if err := g.is.Reorder(gallery.ID, form.Filenames); err != nil {
+		logError(r, err)
+		vd.ErrorAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery)
+}
+
+// MoveGallery puts the gallery in one of its owner's collections
+// POST /galleries/:id/collection
+func (g *Galleries) MoveGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.authorize(w, r, gallery, policy.ManageGallery) {
+		return
+	}
+	vd := g.galleryData(r, gallery, NamedGalleryEditRoute)
+	var form MoveForm
+	if err := parseForm(r, &form); err != nil {
+		logError(r, err)
+		vd.ErrorAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+	if form.CollectionID != 0 {
+		collection, err := g.cs.ByID(form.CollectionID)
+		if err == nil {
+			var allowed bool
+			allowed, err = g.policy.Can(context.User(r.Context()), policy.EditCollection, collection)
+			if err == nil && !allowed {
+				err = models.ErrNotFound
+			}
 		}
-		err = g.is.Create(img, file)
 		if err != nil {
 			vd.ErrorAlert(err)
 			g.EditView.Render(w, r, vd)
 			return
 		}
 	}
-	// if len(nonFileNames) > 0 {
-	// 	vd.ErrorAlert(fmt.Errorf("The file(s) were not uploaded due to unsupported file types: %v", nonFileNames))
-	// 	g.EditView.Render(w, r, vd)
-	// 	return
-	// }
-	url, err := g.r.Get(NamedGalleryEditRoute).URL("id", fmt.Sprintf("%v", gallery.ID))
-	if err != nil {
-		http.Redirect(w, r, "/galleries", http.StatusFound)
+	gallery.CollectionID = form.CollectionID
+	if err := g.gs.As(actor(r)).Update(gallery); err != nil {
+		vd.ErrorAlert(err)
+		g.EditView.Render(w, r, vd)
 		return
 	}
-	http.Redirect(w, r, url.Path, http.StatusFound)
+	g.redirectToEdit(w, r, gallery)
 }
 
 // POST /galleries/:id/images/filename/delete
@@ -178,9 +490,7 @@ func (g *Galleries) DeleteImages(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if !g.authorize(w, r, gallery, policy.EditGallery) {
 		return
 	}
 	filename := mux.Vars(r)["filename"]
@@ -188,20 +498,13 @@ func (g *Galleries) DeleteImages(w http.ResponseWriter, r *http.Request) {
 		GalleryID: gallery.ID,
 		Filename:  filename,
 	}
-	if err := g.is.Delete(img); err != nil {
-		var vd views.Data
-		vd.Yeild = gallery
+	if err := g.is.As(actor(r)).Delete(img); err != nil {
+		vd := g.galleryData(r, gallery, NamedGalleryEditRoute)
 		vd.ErrorAlert(err)
 		g.EditView.Render(w, r, vd)
 		return
 	}
-	url, err := g.r.Get(NamedGalleryEditRoute).URL("id", fmt.Sprintf("%v", gallery.ID))
-	if err != nil {
-		log.Println(err)
-		http.Redirect(w, r, "/galleries", http.StatusFound)
-		return
-	}
-	http.Redirect(w, r, url.Path, http.StatusFound)
+	g.redirectToEdit(w, r, gallery)
 }
 
 // POST /galleries
@@ -209,7 +512,7 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 	var vd views.Data
 	var form GalleryForm
 	if err := parseForm(r, &form); err != nil {
-		log.Println(err)
+		logError(r, err)
 		vd.ErrorAlert(err)
 		g.New.Render(w, r, vd)
 		return
@@ -219,18 +522,12 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 		Title:  form.Title,
 		UserID: user.ID,
 	}
-	if err := g.gs.Create(&gallery); err != nil {
+	if err := g.gs.As(actor(r)).Create(&gallery); err != nil {
 		vd.ErrorAlert(err)
 		g.New.Render(w, r, vd)
 		return
 	}
-	url, err := g.r.Get(NamedGalleryEditRoute).URL("id", fmt.Sprintf("%v", gallery.ID))
-	if err != nil {
-		log.Println(err)
-		http.Redirect(w, r, "/galleries", http.StatusFound)
-		return
-	}
-	http.Redirect(w, r, url.Path, http.StatusFound)
+	g.redirectToEdit(w, r, &gallery)
 }
 
 func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
@@ -238,13 +535,11 @@ func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if !g.authorize(w, r, gallery, policy.ManageGallery) {
 		return
 	}
 	var vd views.Data
-	if err := g.gs.Delete(gallery.ID); err != nil {
+	if err := g.gs.As(actor(r)).Delete(gallery.ID); err != nil {
 		vd.ErrorAlert(err)
 		vd.Yeild = gallery
 		g.EditView.Render(w, r, vd)
@@ -254,13 +549,14 @@ func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 }
 
 // galleryByID gets gorilla mux url variables out and returns a gallery with that ID along with
-// all of its images and no error.  If one does not exits with that id it will return nil and an error
+// the requested page of its images and no error.  Private galleries are only found for their owner
+// and collaborators.  If one does not exits with that id it will return nil and an error
 func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
 	vars := mux.Vars(r)
 	idStr := vars["id"]
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		log.Println(err)
+		logError(r, err)
 		http.Error(w, "Invalid gallery ID", http.StatusNotFound)
 		return nil, err
 	}
@@ -272,11 +568,88 @@ func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models
 	case nil:
 		break
 	default:
-		log.Println(err)
+		logError(r, err)
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return nil, err
+	}
+	if !g.authorize(w, r, gallery, policy.ViewGallery) {
+		return nil, models.ErrNotFound
+	}
+	if err := g.loadImages(r, gallery); err != nil {
+		logError(r, err)
 		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
 		return nil, err
 	}
-	images, _ := g.is.ByGalleryID(gallery.ID)
-	gallery.Images = images
 	return gallery, nil
 }
+
+// loadImages loads the page of a gallery's images asked for by the page
+// query parameter and how many images the gallery has in total
+func (g *Galleries) loadImages(r *http.Request, gallery *models.Gallery) error {
+	page := pageNumber(r)
+	offset := (page - 1) * models.ImagePageSize
+	images, total, err := g.is.PageByGallery(gallery, offset, models.ImagePageSize)
+	if err != nil {
+		return err
+	}
+	gallery.Images = images
+	gallery.ImageCount = total
+	gallery.ImagePage = page
+	return nil
+}
+
+// galleryData returns the view data for a gallery along with the trail of
+// collections it is in and links to the other pages of its images on the
+// named route
+func (g *Galleries) galleryData(r *http.Request, gallery *models.Gallery, route string) views.Data {
+	vd := views.Data{Yeild: gallery}
+	path, err := g.cs.Path(gallery.CollectionID)
+	if err != nil {
+		context.Logger(r.Context()).Error("loading gallery path", "gallery_id", gallery.ID, "error", err)
+	}
+	vd.Breadcrumbs = append(breadcrumbs(r, g.r, path), views.Breadcrumb{Name: gallery.Title})
+	if route == NamedGalleryEditRoute && gallery.CanManage() {
+		gallery.CollectionOptions, err = g.cs.ByUserID(gallery.UserID)
+		if err != nil {
+			context.Logger(r.Context()).Error("loading collection options", "gallery_id", gallery.ID, "error", err)
+		}
+		gallery.Collaborators, err = g.collabs.ByGalleryID(gallery.ID)
+		if err != nil {
+			context.Logger(r.Context()).Error("loading collaborators", "gallery_id", gallery.ID, "error", err)
+		}
+	}
+	id := []string{"id", fmt.Sprintf("%v", gallery.ID)}
+	vd.Pagination = pagination(r, g.r, route, id, gallery.ImagePage, gallery.ImageCount, models.ImagePageSize)
+	return vd
+}
+
+// authorize checks that the policy lets the current user take action on
+// the gallery and responds as if the gallery does not exist when it does not
+func (g *Galleries) authorize(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, action policy.Action) bool {
+	allowed, err := g.policy.Can(context.User(r.Context()), action, gallery)
+	if err != nil {
+		logError(r, err)
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return false
+	}
+	if !allowed {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// redirectToEdit sends the user back to the gallery's edit page, staying
+// on the page of images they were looking at
+func (g *Galleries) redirectToEdit(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) {
+	id := []string{"id", fmt.Sprintf("%v", gallery.ID)}
+	url := pageURL(r, g.r, NamedGalleryEditRoute, id, "", "")
+	if page := r.URL.Query().Get("page"); page != "" {
+		url = pageURL(r, g.r, NamedGalleryEditRoute, id, "page", page)
+	}
+	if url == "" {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, url, http.StatusFound)
+}
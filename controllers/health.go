@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"lenslocked.com/buildinfo"
+)
+
+// readyTimeout is how long the readiness checks get before the site is
+// reported as not ready
+const readyTimeout = 2 * time.Second
+
+// Dependencies are what the site needs to be working to serve requests,
+// it is satisfied by *models.Services
+type Dependencies interface {
+	Ping(ctx context.Context) error
+	CheckStorage() error
+}
+
+func NewHealth(deps Dependencies) *Health {
+	return &Health{deps: deps}
+}
+
+// Health answers the probes of load balancers and orchestrators.  Its
+// handlers are served without the user and csrf middleware so they work
+// without cookies and do not touch the users table.
+type Health struct {
+	deps Dependencies
+	// stopping is set once the server starts shutting down
+	stopping int32
+}
+
+// readiness is the body of /readyz, each check is "ok" or "failed" with
+// why it failed only logged so it is not shown to anyone probing the site
+type readiness struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Live reports that the process is up and able to serve requests
+// GET /healthz
+func (h *Health) Live(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
+
+// Ready reports if the site can serve requests, the database must answer
+// and images must be writable.  It fails once the server is shutting down
+// so load balancers stop sending it new requests.
+// GET /readyz
+func (h *Health) Ready(w http.ResponseWriter, r *http.Request) {
+	ready := readiness{Status: "ok", Checks: map[string]string{}}
+	check := func(name string, err error) {
+		if err != nil {
+			logError(r, fmt.Errorf("readyz: %s: %v", name, err))
+			ready.Status = "unavailable"
+			ready.Checks[name] = "failed"
+			return
+		}
+		ready.Checks[name] = "ok"
+	}
+	if atomic.LoadInt32(&h.stopping) == 1 {
+		ready.Status = "shutting down"
+	} else {
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+		check("database", h.deps.Ping(ctx))
+		check("storage", h.deps.CheckStorage())
+	}
+	status := http.StatusOK
+	if ready.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, ready)
+}
+
+// Version reports which build is running
+// GET /version
+func (h *Health) Version(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, buildinfo.Read())
+}
+
+// ShutDown makes the site report that it is not ready, it is called once
+// the server starts shutting down
+func (h *Health) ShutDown() {
+	atomic.StoreInt32(&h.stopping, 1)
+}
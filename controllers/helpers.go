@@ -1,15 +1,15 @@
 package controllers
 
 import (
+	"encoding/json"
+	"log/slog"
+	"net"
 	"net/http"
-	"path/filepath"
 
 	schema "github.com/gorilla/Schema"
-)
-
-var (
-	// PermittedExtensions are the file types that are allowed for uploads
-	PermittedExtensions = []string{"jpg", "jpeg", "png"}
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/views"
 )
 
 func parseForm(r *http.Request, dst interface{}) error {
@@ -24,16 +24,77 @@ func parseForm(r *http.Request, dst interface{}) error {
 	return nil
 }
 
-func hasPermittedExension(filename string) bool {
-	extension := filepath.Ext(filename)
-	for _, ext := range PermittedExtensions {
-		if ext == extension {
-			return true
-		}
+// parseQuery decodes the url query parameters of r into dst
+func parseQuery(r *http.Request, dst interface{}) error {
+	dec := schema.NewDecoder()
+	dec.IgnoreUnknownKeys(true)
+	return dec.Decode(dst, r.URL.Query())
+}
+
+// logError logs an error that happened while serving r along with the id
+// of the request and the user making it
+func logError(r *http.Request, err error) {
+	context.Logger(r.Context()).Error("request error", "error", err)
+}
+
+// viewerID returns the id of the logged in user or 0 for visitors
+func viewerID(r *http.Request) uint {
+	if user := context.User(r.Context()); user != nil {
+		return user.ID
+	}
+	return 0
+}
+
+// actor returns who is making the request and where from for the audit log
+func actor(r *http.Request) models.Actor {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return models.Actor{UserID: viewerID(r), IP: ip, UserAgent: r.UserAgent()}
+}
+
+// imageJSON is the JSON representation of an image
+type imageJSON struct {
+	URL      string `json:"url"`
+	Filename string `json:"filename"`
+	Title    string `json:"title"`
+	Caption  string `json:"caption"`
+	AltText  string `json:"alt_text"`
+}
+
+func newImageJSON(img *models.Image) *imageJSON {
+	return &imageJSON{
+		URL:      img.RelPath(),
+		Filename: img.Filename,
+		Title:    img.Title,
+		Caption:  img.Caption,
+		AltText:  img.AltText,
+	}
+}
+
+// writeJSON encodes v as the JSON body of a response with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("writing json response", "error", err)
+	}
+}
+
+// writeJSONError responds with the public message of err if it has one
+// and a generic message otherwise
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	msg := views.AlertMsgGeneric
+	if pErr, ok := err.(views.PublicError); ok {
+		msg = pErr.Public()
 	}
-	return false
+	writeJSON(w, status, map[string]string{"error": msg})
 }
 
-func invalidExension(filename string) bool {
-	return !hasPermittedExension(filename)
+// writeJSONServerError logs err and responds with a generic message, the
+// details of what went wrong are never sent to the client
+func writeJSONServerError(w http.ResponseWriter, r *http.Request, err error) {
+	logError(r, err)
+	writeJSON(w, http.StatusInternalServerError, map[string]string{"error": views.AlertMsgGeneric})
 }
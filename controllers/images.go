@@ -0,0 +1,57 @@
+package controllers
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/models"
+	"lenslocked.com/policy"
+)
+
+// ServeImage serves an image file of a gallery to users who can see the
+// gallery, everyone else is told it does not exist.  Images of private
+// galleries are not kept by shared caches.
+// GET /images/galleries/:id/:filename
+func (g *Galleries) ServeImage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	filename := vars["filename"]
+	// temp files of uploads in progress start with a dot
+	if err != nil || filename == "" || strings.HasPrefix(filename, ".") {
+		http.NotFound(w, r)
+		return
+	}
+	gallery, err := g.gs.ByID(uint(id))
+	switch err {
+	case nil:
+	case models.ErrNotFound:
+		http.NotFound(w, r)
+		return
+	default:
+		logError(r, err)
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	if !g.authorize(w, r, gallery, policy.ViewGallery) {
+		return
+	}
+	img := models.Image{GalleryID: gallery.ID, Filename: filename}
+	f, err := os.Open(img.RootPath())
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	if gallery.Private {
+		w.Header().Set("Cache-Control", "private")
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
@@ -0,0 +1,106 @@
+package controllers
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/context"
+	"lenslocked.com/views"
+)
+
+// pageLinkSpan is how many page links are shown either side of the
+// current page
+const pageLinkSpan = 4
+
+// pageNumber returns the page asked for by the page query parameter,
+// pages are numbered from 1
+func pageNumber(r *http.Request) int {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		return 1
+	}
+	return page
+}
+
+// pagination builds the links between pages of size items on the named
+// route with pairs as its url variables.  It returns nil when everything
+// fits on one page.
+func pagination(r *http.Request, router *mux.Router, route string, pairs []string, current, total, size int) *views.Pagination {
+	pages := (total + size - 1) / size
+	if pages <= 1 {
+		return nil
+	}
+	p := &views.Pagination{}
+	if current > 1 {
+		p.Prev = pageURL(r, router, route, pairs, "page", strconv.Itoa(current-1))
+	}
+	if current < pages {
+		p.Next = pageURL(r, router, route, pairs, "page", strconv.Itoa(current+1))
+	}
+	first := current - pageLinkSpan
+	if first < 1 {
+		first = 1
+	}
+	last := current + pageLinkSpan
+	if last > pages {
+		last = pages
+	}
+	for n := first; n <= last; n++ {
+		p.Pages = append(p.Pages, views.PageLink{
+			Number:  n,
+			URL:     pageURL(r, router, route, pairs, "page", strconv.Itoa(n)),
+			Current: n == current,
+		})
+	}
+	return p
+}
+
+// pageURL builds the url of the named route with pairs as its url
+// variables and the query parameter key set to value when key is not empty
+func pageURL(r *http.Request, router *mux.Router, route string, pairs []string, key, value string) string {
+	url, err := router.Get(route).URL(pairs...)
+	if err != nil {
+		context.Logger(r.Context()).Error("building page url", "route", route, "error", err)
+		return ""
+	}
+	if key != "" {
+		q := url.Query()
+		q.Set(key, value)
+		url.RawQuery = q.Encode()
+	}
+	return url.String()
+}
+
+// keepQuery adds the query parameters of r other than the page to every
+// link in p so filters are kept when moving between pages
+func keepQuery(p *views.Pagination, r *http.Request) {
+	if p == nil {
+		return
+	}
+	keep := func(link string) string {
+		if link == "" {
+			return link
+		}
+		u, err := url.Parse(link)
+		if err != nil {
+			logError(r, err)
+			return link
+		}
+		q := u.Query()
+		for key, values := range r.URL.Query() {
+			if key != "page" {
+				q[key] = values
+			}
+		}
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	p.First = keep(p.First)
+	p.Prev = keep(p.Prev)
+	p.Next = keep(p.Next)
+	for i := range p.Pages {
+		p.Pages[i].URL = keep(p.Pages[i].URL)
+	}
+}
@@ -0,0 +1,40 @@
+package controllers
+
+import (
+	"net/http"
+
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+func NewSearch(ss models.SearchService, is models.ImageService) *Search {
+	return &Search{
+		ResultsView: views.NewView("bootstrap", "search/results", "collections/contents"),
+		ss:          ss,
+		is:          is,
+	}
+}
+
+type Search struct {
+	ResultsView *views.View
+	ss          models.SearchService
+	is          models.ImageService
+}
+
+// Results lists the galleries and images matching the q query parameter
+// that the current user is allowed to see
+// GET /search
+func (s *Search) Results(w http.ResponseWriter, r *http.Request) {
+	results, err := s.ss.Search(r.URL.Query().Get("q"), viewerID(r))
+	if err == nil {
+		err = s.is.Summarize(results.Galleries)
+	}
+	if err != nil {
+		logError(r, err)
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	var vd views.Data
+	vd.Yeild = results
+	s.ResultsView.Render(w, r, vd)
+}
@@ -1,19 +1,38 @@
 package controllers
 
 import (
+	"net/http"
+	"net/url"
+
 	"lenslocked.com/views"
 )
 
 // NewStatic returns a new static structure
 func NewStatic() *Static {
 	return &Static{
-		Home:    views.NewView("bootstrap", "static/home"),
-		Contact: views.NewView("bootstrap", "static/contact"),
+		Home:            views.NewView("bootstrap", "static/home"),
+		Contact:         views.NewView("bootstrap", "static/contact"),
+		CSRFFailureView: views.NewView("bootstrap", "static/csrf_failure"),
 	}
 }
 
 // Static contains all the views used in the site
 type Static struct {
-	Home    *views.View
-	Contact *views.View
+	Home            *views.View
+	Contact         *views.View
+	CSRFFailureView *views.View
+}
+
+// CSRFFailure explains to users that a form they sent was rejected because
+// its csrf token was missing or did not match, usually because the page
+// was open for too long.  They are only linked back to the form when it
+// was on this site.
+func (s *Static) CSRFFailure(w http.ResponseWriter, r *http.Request) {
+	var back string
+	if u, err := url.Parse(r.Referer()); err == nil && u.Host == r.Host {
+		back = u.RequestURI()
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusForbidden)
+	s.CSRFFailureView.Render(w, r, back)
 }
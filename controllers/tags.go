@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+const (
+	NamedTagShowRoute = "tags_show"
+	// maxTagSuggestions is how many tags autocomplete suggests at once
+	maxTagSuggestions = 10
+)
+
+func NewTags(gs models.GalleryService, is models.ImageService, r *mux.Router) *Tags {
+	return &Tags{
+		ShowView: views.NewView("bootstrap", "tags/show", "collections/contents"),
+		gs:       gs,
+		is:       is,
+		r:        r,
+	}
+}
+
+type Tags struct {
+	ShowView *views.View
+	gs       models.GalleryService
+	is       models.ImageService
+	r        *mux.Router
+}
+
+// tagPage is everything listed on a tag's page
+type tagPage struct {
+	Name      string
+	Galleries []models.Gallery
+	Images    []models.Image
+}
+
+// Show lists the galleries and images with a tag that the current user
+// is allowed to see
+// GET /tags/:tag
+func (t *Tags) Show(w http.ResponseWriter, r *http.Request) {
+	name := models.NormalizeTag(mux.Vars(r)["tag"])
+	viewer := viewerID(r)
+	galleries, err := t.gs.ByTag(name, viewer)
+	if err == nil {
+		err = t.is.Summarize(galleries)
+	}
+	if err != nil {
+		logError(r, err)
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	page := pageNumber(r)
+	offset := (page - 1) * models.ImagePageSize
+	images, total, err := t.is.PageByTag(name, viewer, offset, models.ImagePageSize)
+	if err != nil {
+		logError(r, err)
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	var vd views.Data
+	vd.Yeild = tagPage{Name: name, Galleries: galleries, Images: images}
+	vd.Pagination = pagination(r, t.r, NamedTagShowRoute, []string{"tag", name}, page, total, models.ImagePageSize)
+	t.ShowView.Render(w, r, vd)
+}
+
+// Autocomplete suggests the current user's tags that start with the q
+// query parameter
+// GET /tags/autocomplete
+func (t *Tags) Autocomplete(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	tags, err := t.gs.TagsByPrefix(user.ID, r.URL.Query().Get("q"), maxTagSuggestions)
+	if err != nil {
+		writeJSONServerError(w, r, err)
+		return
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+	writeJSON(w, http.StatusOK, tags)
+}
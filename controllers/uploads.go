@@ -0,0 +1,193 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/policy"
+)
+
+const (
+	// maxChunkSize is the largest chunk accepted by a single PATCH request
+	maxChunkSize = 8 << 20 // 8 megabytes
+	// uploadOffsetHeader holds the offset a chunk starts at
+	uploadOffsetHeader = "Upload-Offset"
+)
+
+// UploadForm contains the information needed to start a resumable upload
+type UploadForm struct {
+	Filename string `schema:"filename"`
+	Size     int64  `schema:"size"`
+}
+
+// uploadStatus is the JSON representation of a resumable upload
+type uploadStatus struct {
+	ID       uint       `json:"id"`
+	Filename string     `json:"filename"`
+	Size     int64      `json:"size"`
+	Offset   int64      `json:"offset"`
+	Complete bool       `json:"complete"`
+	Image    *imageJSON `json:"image,omitempty"`
+}
+
+func newUploadStatus(upload *models.Upload, img *models.Image) uploadStatus {
+	status := uploadStatus{
+		ID:       upload.ID,
+		Filename: upload.Filename,
+		Size:     upload.Size,
+		Offset:   upload.Offset,
+		Complete: upload.Complete(),
+	}
+	if img != nil {
+		status.Image = newImageJSON(img)
+	}
+	return status
+}
+
+// CreateUpload starts a resumable upload of a single image to a gallery
+// POST /galleries/:id/uploads
+func (g *Galleries) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.authorize(w, r, gallery, policy.UploadImages) {
+		return
+	}
+	user := context.User(r.Context())
+	var form UploadForm
+	if err := parseForm(r, &form); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	upload := models.Upload{
+		GalleryID: gallery.ID,
+		UserID:    user.ID,
+		Filename:  form.Filename,
+		Size:      form.Size,
+	}
+	if err := g.us.Create(&upload); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newUploadStatus(&upload, nil))
+}
+
+// UploadStatus reports how much of an upload has been received so a
+// client can resume it
+// GET /galleries/:id/uploads/:upload_id
+func (g *Galleries) UploadStatus(w http.ResponseWriter, r *http.Request) {
+	upload, err := g.uploadByID(w, r)
+	if err != nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, newUploadStatus(upload, nil))
+}
+
+// WriteUpload appends the request body to an upload starting at the
+// offset in the Upload-Offset header.  The image is created in the
+// gallery as soon as the last chunk has been received.
+// PATCH /galleries/:id/uploads/:upload_id
+func (g *Galleries) WriteUpload(w http.ResponseWriter, r *http.Request) {
+	upload, err := g.uploadByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.canUploadTo(w, r, upload) {
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get(uploadOffsetHeader), 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, models.ErrUploadOffset)
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, maxChunkSize)
+	img, err := g.us.As(actor(r)).WriteChunk(r.Context(), upload, offset, body)
+	var maxErr *http.MaxBytesError
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, newUploadStatus(upload, img))
+	case err == models.ErrUploadOffset:
+		writeJSON(w, http.StatusConflict, newUploadStatus(upload, nil))
+	case err == models.ErrImageType || err == models.ErrUploadSize:
+		writeJSONError(w, http.StatusUnprocessableEntity, err)
+	case errors.As(err, &maxErr):
+		writeJSONError(w, http.StatusRequestEntityTooLarge, err)
+	default:
+		writeJSONServerError(w, r, err)
+	}
+}
+
+// CancelUpload discards an upload and everything received for it
+// DELETE /galleries/:id/uploads/:upload_id
+func (g *Galleries) CancelUpload(w http.ResponseWriter, r *http.Request) {
+	upload, err := g.uploadByID(w, r)
+	if err != nil {
+		return
+	}
+	if err := g.us.Delete(upload.ID); err != nil {
+		writeJSONServerError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadByID looks up the upload in the url variables and makes sure it
+// belongs to both the gallery in the url and the current user
+func (g *Galleries) uploadByID(w http.ResponseWriter, r *http.Request) (*models.Upload, error) {
+	galleryID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, models.ErrNotFound)
+		return nil, err
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["upload_id"])
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, models.ErrNotFound)
+		return nil, err
+	}
+	upload, err := g.us.ByID(uint(id))
+	switch err {
+	case models.ErrNotFound:
+		writeJSONError(w, http.StatusNotFound, err)
+		return nil, err
+	case nil:
+		break
+	default:
+		writeJSONServerError(w, r, err)
+		return nil, err
+	}
+	allowed, err := g.policy.Can(context.User(r.Context()), policy.EditUpload, upload)
+	if err != nil {
+		writeJSONServerError(w, r, err)
+		return nil, err
+	}
+	if upload.GalleryID != uint(galleryID) || !allowed {
+		writeJSONError(w, http.StatusNotFound, models.ErrNotFound)
+		return nil, models.ErrNotFound
+	}
+	return upload, nil
+}
+
+// canUploadTo makes sure the user may still upload images to the gallery
+// of an upload they started, a collaborator can lose their role before
+// they finish
+func (g *Galleries) canUploadTo(w http.ResponseWriter, r *http.Request, upload *models.Upload) bool {
+	gallery, err := g.gs.ByID(upload.GalleryID)
+	allowed := false
+	if err == nil {
+		allowed, err = g.policy.Can(context.User(r.Context()), policy.UploadImages, gallery)
+	}
+	switch {
+	case err == models.ErrNotFound || (err == nil && !allowed):
+		writeJSONError(w, http.StatusNotFound, models.ErrNotFound)
+		return false
+	case err != nil:
+		writeJSONServerError(w, r, err)
+		return false
+	}
+	return true
+}
@@ -2,33 +2,46 @@ package controllers
 
 import (
 	"fmt"
-	"log"
 	"net/http"
 	"time"
 
+	"github.com/gorilla/mux"
 	"lenslocked.com/context"
 	"lenslocked.com/models"
 	"lenslocked.com/rand"
 	"lenslocked.com/views"
 )
 
+const NamedAccountActivityRoute = "account_activity"
+
 // NewUsers is used to create a new users controller.
 // Function will panic if the templates are not parsed
-// correctly and should only be used during setup
-func NewUsers(us models.UserService) *Users {
+// correctly and should only be used during setup.  secureCookies
+// should be set when the site is served over https.
+func NewUsers(us models.UserService, audit models.AuditService, secureCookies bool, r *mux.Router) *Users {
 	return &Users{
-		NewView:   views.NewView("bootstrap", "users/new"),
-		LoginView: views.NewView("bootstrap", "users/login"),
-		us:        us,
+		NewView:           views.NewView("bootstrap", "users/new"),
+		LoginView:         views.NewView("bootstrap", "users/login"),
+		ResetPasswordView: views.NewView("bootstrap", "users/reset_password"),
+		ActivityView:      views.NewView("bootstrap", "users/activity"),
+		us:                us,
+		audit:             audit,
+		secureCookies:     secureCookies,
+		r:                 r,
 	}
 }
 
 // Users are used to control which template is rendered
 // for the templates page.
 type Users struct {
-	NewView   *views.View
-	LoginView *views.View
-	us        models.UserService
+	NewView           *views.View
+	LoginView         *views.View
+	ResetPasswordView *views.View
+	ActivityView      *views.View
+	us                models.UserService
+	audit             models.AuditService
+	secureCookies     bool
+	r                 *mux.Router
 }
 
 // New renders users templates for the Users type
@@ -51,7 +64,7 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 	var vd views.Data
 	var form SignupForm
 	if err := parseForm(r, &form); err != nil {
-		log.Println(err)
+		logError(r, err)
 		vd.ErrorAlert(err)
 		u.NewView.Render(w, r, vd)
 		return
@@ -61,7 +74,7 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 		Email:    form.Email,
 		Password: form.Password,
 	}
-	if err := u.us.Create(&user); err != nil {
+	if err := u.us.As(actor(r)).Create(&user); err != nil {
 		vd.ErrorAlert(err)
 		u.NewView.Render(w, r, vd)
 		return
@@ -84,18 +97,12 @@ type LoginForm struct {
 // set the remember token for the user to some new value in the db.
 // Finally it redirects the user to the homepage
 func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
-	cookie := http.Cookie{
-		Name:     "remember_token",
-		Value:    "",
-		Expires:  time.Now(),
-		HttpOnly: true,
-	}
-	http.SetCookie(w, &cookie)
+	http.SetCookie(w, u.rememberCookie("", time.Now()))
 
 	user := context.User(r.Context())
-	token, _ := rand.RememberToken()
-	user.Remember = token
-	u.us.Update(user)
+	if err := u.us.As(actor(r)).LogOut(user); err != nil {
+		logError(r, err)
+	}
 
 	http.Redirect(w, r, "/", http.StatusFound)
 }
@@ -107,17 +114,19 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 	var vd views.Data
 	var form LoginForm
 	if err := parseForm(r, &form); err != nil {
-		log.Println(err)
+		logError(r, err)
 		vd.ErrorAlert(err)
 		u.LoginView.Render(w, r, vd)
 		return
 	}
-	user, err := u.us.Authenticate(form.Email, form.Password)
+	user, err := u.us.As(actor(r)).Authenticate(form.Email, form.Password)
 	switch err {
 	case models.ErrNotFound:
 		fmt.Fprintln(w, "Invalid email address.")
 	case models.ErrPasswordIncorrect:
 		fmt.Fprintln(w, "Invalid password provided.")
+	case models.ErrAccountDisabled:
+		fmt.Fprintln(w, "This account has been disabled.")
 	case nil:
 		break
 	default:
@@ -134,6 +143,63 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/galleries", http.StatusFound)
 }
 
+// ResetPasswordForm contains the new password a user chose
+type ResetPasswordForm struct {
+	Password string `schema:"password"`
+}
+
+// EditPassword asks the current user for a new password, users an admin
+// asked to change their password are sent here until they do
+// GET /password/reset
+func (u *Users) EditPassword(w http.ResponseWriter, r *http.Request) {
+	u.ResetPasswordView.Render(w, r, context.User(r.Context()))
+}
+
+// ResetPassword sets a new password for the current user
+// POST /password/reset
+func (u *Users) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	vd := views.Data{Yeild: user}
+	var form ResetPasswordForm
+	if err := parseForm(r, &form); err != nil {
+		logError(r, err)
+		vd.ErrorAlert(err)
+		u.ResetPasswordView.Render(w, r, vd)
+		return
+	}
+	if form.Password == "" {
+		vd.ErrorAlert(models.ErrPasswordRequired)
+		u.ResetPasswordView.Render(w, r, vd)
+		return
+	}
+	user.Password = form.Password
+	user.PasswordResetRequired = false
+	if err := u.us.As(actor(r)).Update(user); err != nil {
+		vd.ErrorAlert(err)
+		u.ResetPasswordView.Render(w, r, vd)
+		return
+	}
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+// Activity lists what has happened on the current user's account and
+// galleries, like logins and images collaborators uploaded, newest first
+// GET /account/activity
+func (u *Users) Activity(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	page := pageNumber(r)
+	events, total, err := u.audit.ByUserID(user.ID, (page-1)*models.AuditPageSize, models.AuditPageSize)
+	if err != nil {
+		logError(r, err)
+		http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	var vd views.Data
+	vd.Yeild = events
+	vd.Pagination = pagination(r, u.r, NamedAccountActivityRoute, nil, page, total, models.AuditPageSize)
+	u.ActivityView.Render(w, r, vd)
+}
+
 // signIn creates a cookie for the user using their email that expires an hour
 // after not refreshing the page.  This function is called for /login and /singup routes
 func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
@@ -148,12 +214,19 @@ func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
 			return err
 		}
 	}
-	cookie := http.Cookie{
+	http.SetCookie(w, u.rememberCookie(user.Remember, time.Now().Add(models.SessionLength)))
+	return nil
+}
+
+// rememberCookie is the cookie users stay logged in with, it is only sent
+// over https when the site is served with TLS
+func (u *Users) rememberCookie(value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
 		Name:     "remember_token",
-		Value:    user.Remember,
-		Expires:  time.Now().Add(time.Hour),
+		Value:    value,
+		Expires:  expires,
 		HttpOnly: true,
+		Secure:   u.secureCookies,
+		SameSite: http.SameSiteLaxMode,
 	}
-	http.SetCookie(w, &cookie)
-	return nil
 }
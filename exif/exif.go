@@ -0,0 +1,259 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"time"
+
+	goexif "github.com/rwcarlsen/goexif/exif"
+)
+
+// ErrNoExif is returned when an image does not contain any EXIF metadata
+var ErrNoExif = errors.New("exif: no exif metadata found")
+
+// Info contains the EXIF fields of a photo that are worth keeping.
+// Fields that were not present in the photo are left as zero values.
+type Info struct {
+	Make         string
+	Model        string
+	LensModel    string
+	ExposureTime string
+	FNumber      float64
+	ISO          int
+	FocalLength  float64
+	TakenAt      *time.Time
+	Orientation  int
+	HasGPS       bool
+	Latitude     float64
+	Longitude    float64
+}
+
+// Read decodes the EXIF metadata of a jpg.  ErrNoExif is returned if
+// there is none, fields that cannot be parsed are skipped.
+func Read(r io.Reader) (*Info, error) {
+	x, err := goexif.Decode(r)
+	if x == nil || (err != nil && goexif.IsCriticalError(err)) {
+		return nil, ErrNoExif
+	}
+	info := Info{
+		Make:         str(x, goexif.Make),
+		Model:        str(x, goexif.Model),
+		LensModel:    str(x, goexif.LensModel),
+		ExposureTime: exposure(x),
+		FNumber:      float(x, goexif.FNumber),
+		ISO:          integer(x, goexif.ISOSpeedRatings),
+		FocalLength:  float(x, goexif.FocalLength),
+		Orientation:  integer(x, goexif.Orientation),
+	}
+	if t, err := x.DateTime(); err == nil {
+		info.TakenAt = &t
+	}
+	if lat, long, err := x.LatLong(); err == nil {
+		info.HasGPS = true
+		info.Latitude = lat
+		info.Longitude = long
+	}
+	return &info, nil
+}
+
+func str(x *goexif.Exif, name goexif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+func integer(x *goexif.Exif, name goexif.FieldName) int {
+	tag, err := x.Get(name)
+	if err != nil {
+		return 0
+	}
+	i, err := tag.Int(0)
+	if err != nil {
+		return 0
+	}
+	return i
+}
+
+func float(x *goexif.Exif, name goexif.FieldName) float64 {
+	rat := rational(x, name)
+	if rat == nil {
+		return 0
+	}
+	f, _ := rat.Float64()
+	return f
+}
+
+func rational(x *goexif.Exif, name goexif.FieldName) *big.Rat {
+	tag, err := x.Get(name)
+	if err != nil {
+		return nil
+	}
+	rat, err := tag.Rat(0)
+	if err != nil {
+		return nil
+	}
+	return rat
+}
+
+// exposure formats the exposure time the way cameras show it
+// i.e. "1/250" for fast shutter speeds and "2.5" for slow ones
+func exposure(x *goexif.Exif) string {
+	rat := rational(x, goexif.ExposureTime)
+	if rat == nil || rat.Sign() <= 0 {
+		return ""
+	}
+	if rat.Cmp(big.NewRat(1, 1)) >= 0 {
+		return rat.FloatString(1)
+	}
+	denom := new(big.Rat).Inv(rat)
+	return fmt.Sprintf("1/%s", strings.TrimSuffix(denom.FloatString(1), ".0"))
+}
+
+const (
+	markerSOI  = 0xD8
+	markerSOS  = 0xDA
+	markerAPP1 = 0xE1
+	tagGPSIFD  = 0x8825
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	// typeSizes is the size in bytes of each TIFF field type
+	typeSizes = map[uint16]uint32{
+		1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1,
+		7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+	}
+)
+
+// StripGPS returns a copy of a jpg without any location metadata.  The
+// entries of the EXIF GPS directory and the values they point to are
+// overwritten with zeros, every other EXIF field is left untouched.  XMP
+// packets can also hold a location so they are removed entirely.
+func StripGPS(jpg []byte) ([]byte, error) {
+	if len(jpg) < 2 || jpg[0] != 0xFF || jpg[1] != markerSOI {
+		return nil, errors.New("exif: not a jpg")
+	}
+	var out bytes.Buffer
+	out.Grow(len(jpg))
+	out.Write(jpg[:2])
+	i := 2
+	for i+4 <= len(jpg) {
+		if jpg[i] != 0xFF {
+			return nil, errors.New("exif: malformed jpg segment")
+		}
+		marker := jpg[i+1]
+		if marker == 0xFF {
+			// markers may be preceded by any number of fill bytes
+			out.WriteByte(0xFF)
+			i++
+			continue
+		}
+		if marker == markerSOS {
+			break
+		}
+		// the length includes its own two bytes so anything shorter is
+		// invalid
+		length := int(binary.BigEndian.Uint16(jpg[i+2:]))
+		if length < 2 {
+			return nil, errors.New("exif: invalid jpg segment length")
+		}
+		end := i + 2 + length
+		if end > len(jpg) {
+			return nil, errors.New("exif: truncated jpg segment")
+		}
+		segment := jpg[i:end]
+		if marker == markerAPP1 {
+			body := segment[4:]
+			if bytes.HasPrefix(body, xmpHeader) {
+				i = end
+				continue
+			}
+			if bytes.HasPrefix(body, exifHeader) {
+				segment = append([]byte(nil), segment...)
+				if err := zeroGPS(segment[4+len(exifHeader):]); err != nil {
+					return nil, err
+				}
+			}
+		}
+		out.Write(segment)
+		i = end
+	}
+	out.Write(jpg[i:])
+	return out.Bytes(), nil
+}
+
+// zeroGPS clears the GPS directory of a TIFF structure in place
+func zeroGPS(tiff []byte) error {
+	if len(tiff) < 8 {
+		return errors.New("exif: truncated tiff header")
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return errors.New("exif: invalid tiff byte order")
+	}
+	ifd0 := order.Uint32(tiff[4:])
+	entries, err := ifdEntries(tiff, ifd0, order)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if order.Uint16(entry) != tagGPSIFD {
+			continue
+		}
+		gps := order.Uint32(entry[8:])
+		gpsEntries, err := ifdEntries(tiff, gps, order)
+		if err != nil {
+			return err
+		}
+		for _, e := range gpsEntries {
+			size := uint64(typeSizes[order.Uint16(e[2:])]) * uint64(order.Uint32(e[4:]))
+			if size > 4 {
+				offset := uint64(order.Uint32(e[8:]))
+				if offset+size <= uint64(len(tiff)) {
+					clear(tiff[offset : offset+size])
+				}
+			}
+			clear(e)
+		}
+		// an empty directory is still valid so readers that follow the
+		// GPS pointer find nothing instead of failing
+		order.PutUint16(tiff[gps:], 0)
+	}
+	return nil
+}
+
+// ifdEntries returns slices of the 12 byte entries of the directory at
+// offset which alias tiff so they can be modified in place
+func ifdEntries(tiff []byte, offset uint32, order binary.ByteOrder) ([][]byte, error) {
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return nil, errors.New("exif: directory out of bounds")
+	}
+	n := uint32(order.Uint16(tiff[offset:]))
+	start := offset + 2
+	if uint64(start)+uint64(n)*12 > uint64(len(tiff)) {
+		return nil, errors.New("exif: directory out of bounds")
+	}
+	entries := make([][]byte, n)
+	for i := range entries {
+		s := start + uint32(i)*12
+		entries[i] = tiff[s : s+12]
+	}
+	return entries, nil
+}
@@ -0,0 +1,44 @@
+package exif
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStripGPSMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		jpg  []byte
+	}{
+		{"empty", nil},
+		{"not a jpg", []byte("GIF89a")},
+		{"zero length app1", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x00, 0xFF, 0xD9}},
+		{"one byte length app1", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x01, 0xFF, 0xD9}},
+		{"zero length app0", []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x00, 0xFF, 0xD9}},
+		{"truncated segment", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x10, 'E', 'x'}},
+		{"missing marker", []byte{0xFF, 0xD8, 0x00, 0xE1, 0x00, 0x02, 0xFF, 0xD9}},
+		{"truncated tiff", append([]byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x0A}, "Exif\x00\x00II*\x00"...)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := StripGPS(test.jpg); err == nil {
+				t.Errorf("StripGPS(% X) err = nil, want an error", test.jpg)
+			}
+		})
+	}
+}
+
+func TestStripGPSRemovesXMP(t *testing.T) {
+	xmp := append([]byte{0xFF, 0xE1, 0x00, byte(2 + len(xmpHeader) + 3)}, xmpHeader...)
+	xmp = append(xmp, "geo"...)
+	jpg := append([]byte{0xFF, 0xD8}, xmp...)
+	jpg = append(jpg, 0xFF, 0xDA, 0x00, 0x02, 0x01, 0xFF, 0xD9)
+	got, err := StripGPS(jpg)
+	if err != nil {
+		t.Fatalf("StripGPS() err = %v", err)
+	}
+	want := []byte{0xFF, 0xD8, 0xFF, 0xDA, 0x00, 0x02, 0x01, 0xFF, 0xD9}
+	if !bytes.Equal(got, want) {
+		t.Errorf("StripGPS() = % X, want % X", got, want)
+	}
+}
@@ -1,48 +1,104 @@
 package main
 
 import (
-	"flag"
+	"context"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
+	"golang.org/x/crypto/acme/autocert"
 	"lenslocked.com/controllers"
+	"lenslocked.com/email"
+	"lenslocked.com/metrics"
 	"lenslocked.com/middleware"
 	"lenslocked.com/models"
-	"lenslocked.com/rand"
+	"lenslocked.com/policy"
 )
 
 func main() {
-	cfgReq := flag.Bool("prod", false, "set to true in production to ensure that a .config is used when provided")
-	flag.Parse()
-
-	cfg, err := LoadConfig(*cfgReq)
-	must(err)
-	dbCnfg := cfg.Database
-	services, err := models.NewServices(
-		models.WithGorm(dbCnfg.Dialect(), dbCnfg.ConnectionInfo()),
-		models.WithUser(cfg.Pepper, cfg.HMACKey),
-		models.WithGallery(),
-		models.WithImage(),
-		models.WithLogMode(!cfg.InProd()),
-	)
-	must(err)
-	defer services.Close()
-	services.AutoMigrate()
-	// services.DestructiveReset()
+	cmd, args := findCommand(os.Args[1:])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", strings.Join(os.Args[1:], " "))
+		printUsage(os.Stderr)
+		os.Exit(2)
+	}
+	if err := cmd.run(args); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", cmd.name, err)
+		os.Exit(1)
+	}
+}
+
+// runServe migrates the database and serves the site until it is shut
+// down
+// lenslocked [serve] [flags]
+func runServe(args []string) error {
+	fs, cfgFlags := newFlagSet("serve")
+	fs.Parse(args)
+
+	cfg, err := LoadConfig(cfgFlags)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(cfg.Log.NewLogger(os.Stderr))
+	mets := metrics.New()
+	services, err := newServices(cfg, mets)
+	if err != nil {
+		return err
+	}
+	// the servers have stopped by the time this runs so nothing is using
+	// the db anymore
+	defer func() {
+		if err := services.Close(); err != nil {
+			slog.Error("closing services", "error", err)
+		}
+	}()
+	if err := services.AutoMigrate(); err != nil {
+		return err
+	}
+	if err := grantAdmins(services.User, cfg.Admins); err != nil {
+		return err
+	}
+	mets.CountSessions(services.Audit.ActiveSessions)
 
+	pol := policy.New(services.Collaborator)
 	r := mux.NewRouter()
 	staticC := controllers.NewStatic()
-	usersC := controllers.NewUsers(services.User)
-	galleriesC := controllers.NewGalleries(services.Gallery, services.Image, r)
-
-	b, err := rand.Bytes(32)
-	must(err)
-	csrfMw := csrf.Protect(b, csrf.Secure(cfg.InProd()))
+	usersC := controllers.NewUsers(services.User, services.Audit, cfg.TLS.Enabled(), r)
+	var mailer email.Mailer = email.LogMailer{}
+	if mailCfg := cfg.Mail; mailCfg.Host != "" {
+		mailer = email.NewSMTPMailer(mailCfg.Host, mailCfg.Port, mailCfg.Username, mailCfg.Password, mailCfg.From)
+	}
+	galleriesC := controllers.NewGalleries(services.Gallery, services.Image, services.Upload,
+		services.Collection, services.Collaborator, mailer, cfg.BaseURL, pol, r)
+	collectionsC := controllers.NewCollections(services.Collection, services.Gallery, services.Image, pol, r)
+	tagsC := controllers.NewTags(services.Gallery, services.Image, r)
+	searchC := controllers.NewSearch(services.Search, services.Image)
+	adminC := controllers.NewAdmin(services.Admin, services.Audit, services.User, services.Gallery, services.Image, r)
 
 	userMw := middleware.User{UserService: services.User}
+	csrfKeys, err := cfg.CSRFKeys()
+	if err != nil {
+		return err
+	}
+	csrfMw := middleware.CSRF{
+		Keys:   csrfKeys,
+		Secure: cfg.TLS.Enabled(),
+		// the failure page is rendered with the user so the navbar is right
+		Failure: userMw.ApplyFn(staticC.CSRFFailure),
+	}
 	ownerMw := middleware.Owner{User: userMw}
+	createMw := middleware.Authorize{Policy: pol, Action: policy.CreateContent}
+	adminMw := middleware.Admin{Policy: pol}
+	transferMw := middleware.Deadline{Timeout: time.Duration(cfg.Server.TransferTimeout) * time.Second}
 
 	/*
 		Remember routes are prioritized on a first come first serve basis
@@ -57,36 +113,236 @@ func main() {
 	r.Handle("/login", usersC.LoginView).Methods("GET")
 	r.HandleFunc("/login", usersC.Login).Methods("POST")
 	r.HandleFunc("/logout", ownerMw.ApplyFn(usersC.Logout)).Methods("POST")
+	r.HandleFunc(middleware.PasswordResetPath, ownerMw.ApplyFn(usersC.EditPassword)).Methods("GET")
+	r.HandleFunc(middleware.PasswordResetPath, ownerMw.ApplyFn(usersC.ResetPassword)).Methods("POST")
+	r.HandleFunc("/account/activity", ownerMw.ApplyFn(usersC.Activity)).
+		Methods("GET").Name(controllers.NamedAccountActivityRoute)
 	// FileServer for static assets
-	assetHandler := http.FileServer(http.Dir("./assets/"))
+	assetHandler := http.FileServer(noListing{http.Dir("./assets/")})
 	assetHandler = http.StripPrefix("/assets/", assetHandler)
 	r.PathPrefix("/assets/").Handler(assetHandler)
 	// Image Routes
-	imageHandler := http.FileServer(http.Dir("./images/"))
-	r.PathPrefix("/images/").Handler(http.StripPrefix("/images/", imageHandler))
+	r.HandleFunc("/images/galleries/{id:[0-9]+}/{filename}", galleriesC.ServeImage).Methods("GET", "HEAD")
 	// Gallery Routes
-	r.HandleFunc("/galleries", ownerMw.ApplyFn(galleriesC.Index)).Methods("GET")
-	r.Handle("/galleries/new", ownerMw.Apply(galleriesC.New)).Methods("GET")
-	r.HandleFunc("/galleries", ownerMw.ApplyFn(galleriesC.Create)).Methods("POST")
+	r.HandleFunc("/galleries", ownerMw.ApplyFn(galleriesC.Index)).
+		Methods("GET").Name(controllers.NamedGalleryIndexRoute)
+	r.Handle("/galleries/new", createMw.Apply(galleriesC.New)).Methods("GET")
+	r.HandleFunc("/galleries", createMw.ApplyFn(galleriesC.Create)).Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}/images", ownerMw.ApplyFn(galleriesC.UploadImages)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/collection", ownerMw.ApplyFn(galleriesC.MoveGallery)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/cover", ownerMw.ApplyFn(galleriesC.SetCover)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/order", ownerMw.ApplyFn(galleriesC.ReorderImages)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/zip", transferMw.ApplyFn(ownerMw.ApplyFn(galleriesC.ImportZip))).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads", ownerMw.ApplyFn(galleriesC.CreateUpload)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads/{upload_id:[0-9]+}", ownerMw.ApplyFn(galleriesC.UploadStatus)).Methods("GET")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads/{upload_id:[0-9]+}", ownerMw.ApplyFn(galleriesC.WriteUpload)).Methods("PATCH")
+	r.HandleFunc("/galleries/{id:[0-9]+}/uploads/{upload_id:[0-9]+}", ownerMw.ApplyFn(galleriesC.CancelUpload)).Methods("DELETE")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/update", ownerMw.ApplyFn(galleriesC.UpdateImage)).Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete", ownerMw.ApplyFn(galleriesC.DeleteImages)).Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}/update", ownerMw.ApplyFn(galleriesC.Update)).Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}/delete", ownerMw.ApplyFn(galleriesC.Delete)).Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}", galleriesC.Show).
 		Methods("GET").Name(controllers.NamedGalleryShowRoute)
+	r.HandleFunc("/galleries/{id:[0-9]+}/download", transferMw.ApplyFn(galleriesC.Download)).
+		Methods("GET").Name(controllers.NamedGalleryDownloadRoute)
 	r.HandleFunc("/galleries/{id:[0-9]+}/edit", ownerMw.ApplyFn(galleriesC.Edit)).
 		Methods("GET").Name(controllers.NamedGalleryEditRoute)
-	// TODO: config this
+	r.HandleFunc("/galleries/{id:[0-9]+}/collaborators", ownerMw.ApplyFn(galleriesC.InviteCollaborator)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/collaborators/{collaborator_id:[0-9]+}/delete",
+		ownerMw.ApplyFn(galleriesC.RemoveCollaborator)).Methods("POST")
+	// Invitation Routes
+	r.HandleFunc("/invitations/{token}", ownerMw.ApplyFn(galleriesC.ShowInvitation)).Methods("GET")
+	r.HandleFunc("/invitations/{token}", ownerMw.ApplyFn(galleriesC.AcceptInvitation)).Methods("POST")
+	// Collection Routes
+	r.HandleFunc("/collections/new", createMw.ApplyFn(collectionsC.New)).Methods("GET")
+	r.HandleFunc("/collections", createMw.ApplyFn(collectionsC.Create)).Methods("POST")
+	r.HandleFunc("/collections/{id:[0-9]+}/update", ownerMw.ApplyFn(collectionsC.Update)).Methods("POST")
+	r.HandleFunc("/collections/{id:[0-9]+}/delete", ownerMw.ApplyFn(collectionsC.Delete)).Methods("POST")
+	r.HandleFunc("/collections/{id:[0-9]+}", collectionsC.Show).
+		Methods("GET").Name(controllers.NamedCollectionShowRoute)
+	r.HandleFunc("/collections/{id:[0-9]+}/edit", ownerMw.ApplyFn(collectionsC.Edit)).
+		Methods("GET").Name(controllers.NamedCollectionEditRoute)
+	// Tag Routes
+	r.HandleFunc("/tags/autocomplete", ownerMw.ApplyFn(tagsC.Autocomplete)).Methods("GET")
+	r.HandleFunc("/tags/{tag}", tagsC.Show).
+		Methods("GET").Name(controllers.NamedTagShowRoute)
+	// Search Routes
+	r.HandleFunc("/search", searchC.Results).Methods("GET")
+	// Admin Routes
+	r.HandleFunc("/admin", adminMw.ApplyFn(adminC.Users)).
+		Methods("GET").Name(controllers.NamedAdminUsersRoute)
+	r.HandleFunc("/admin/galleries", adminMw.ApplyFn(adminC.Galleries)).
+		Methods("GET").Name(controllers.NamedAdminGalleriesRoute)
+	r.HandleFunc("/admin/audit", adminMw.ApplyFn(adminC.Audit)).
+		Methods("GET").Name(controllers.NamedAdminAuditRoute)
+	r.HandleFunc("/admin/users/{id:[0-9]+}/disable", adminMw.ApplyFn(adminC.DisableUser)).Methods("POST")
+	r.HandleFunc("/admin/users/{id:[0-9]+}/enable", adminMw.ApplyFn(adminC.EnableUser)).Methods("POST")
+	r.HandleFunc("/admin/users/{id:[0-9]+}/reset-password", adminMw.ApplyFn(adminC.ResetPassword)).Methods("POST")
+	r.HandleFunc("/admin/users/{id:[0-9]+}/grant", adminMw.ApplyFn(adminC.GrantAdmin)).Methods("POST")
+	r.HandleFunc("/admin/users/{id:[0-9]+}/revoke", adminMw.ApplyFn(adminC.RevokeAdmin)).Methods("POST")
+	r.HandleFunc("/admin/galleries/{id:[0-9]+}/delete", adminMw.ApplyFn(adminC.RemoveGallery)).Methods("POST")
 
-	// make sure to run go run "$GOROOT/src/crypto/tls/generate_cert.go" --host=localhost
-	// to make this work in development
-	fmt.Printf("listening and serving localhost:%d\n", cfg.Port)
-	// fmt.Printf("listening and serving on port %d\n", cfg.Port)
-	http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), csrfMw(userMw.Apply(r)))
+	// probes and metrics are served before the user and csrf middleware so
+	// they need no cookies, everything else goes on to the site
+	healthC := controllers.NewHealth(services)
+	metricsMw := middleware.Metrics{Router: r, Observer: mets}
+	requestIDMw := middleware.RequestID{}
+	accessLogMw := middleware.AccessLog{}
+	root := mux.NewRouter()
+	root.HandleFunc("/healthz", healthC.Live).Methods("GET", "HEAD")
+	root.HandleFunc("/readyz", healthC.Ready).Methods("GET", "HEAD")
+	root.HandleFunc("/version", healthC.Version).Methods("GET")
+	root.Handle("/metrics", mets.Handler(cfg.MetricsToken)).Methods("GET")
+	root.PathPrefix("/").Handler(accessLogMw.Apply(metricsMw.Apply(csrfMw.Apply(userMw.Apply(r)))))
+
+	var handler http.Handler = requestIDMw.Apply(root)
+	if cfg.TLS.Enabled() {
+		hstsMw := middleware.HSTS{MaxAge: time.Duration(cfg.TLS.HSTSMaxAge) * time.Second}
+		handler = hstsMw.Apply(handler)
+	}
+	return serve(cfg, handler, healthC.ShutDown)
 }
 
-func must(err error) {
+// serve listens on the configured port, over https when TLS is on.  Plain
+// http requests to the redirect port are then sent to the https site.  It
+// returns once a listener fails or, on SIGINT or SIGTERM, once the
+// requests in flight have finished or the shutdown timeout has passed.
+// stopping is called as soon as the shutdown starts, requests are still
+// served for the drain delay after it or until a second signal.
+func serve(cfg *Config, handler http.Handler, stopping func()) error {
+	tlsCfg := cfg.TLS
+	srv := newServer(cfg.Server, cfg.Port, handler)
+	servers := []*http.Server{srv}
+	errs := make(chan error, 2)
+	listen := func(name string, listen func() error) {
+		if err := listen(); err != nil && err != http.ErrServerClosed {
+			errs <- fmt.Errorf("%s listener: %v", name, err)
+		}
+	}
+
+	if !tlsCfg.Enabled() {
+		slog.Info("listening for http", "addr", srv.Addr)
+		go listen("http", srv.ListenAndServe)
+	} else {
+		var redirect http.Handler = redirectHTTPS(cfg.Port)
+		if tlsCfg.Autocert() {
+			m := &autocert.Manager{
+				Prompt:     autocert.AcceptTOS,
+				HostPolicy: autocert.HostWhitelist(tlsCfg.AutocertHosts...),
+				Cache:      autocert.DirCache(tlsCfg.AutocertCache),
+			}
+			srv.TLSConfig = m.TLSConfig()
+			// the manager answers Let's Encrypt's challenges and
+			// redirects everything else
+			redirect = m.HTTPHandler(redirect)
+		}
+		if tlsCfg.RedirectPort != 0 {
+			redirectSrv := newServer(cfg.Server, tlsCfg.RedirectPort, redirect)
+			servers = append(servers, redirectSrv)
+			slog.Info("redirecting http to https", "addr", redirectSrv.Addr)
+			go listen("redirect", redirectSrv.ListenAndServe)
+		}
+		slog.Info("listening for https", "addr", srv.Addr)
+		// with autocert the certificates come from srv.TLSConfig
+		go listen("https", func() error {
+			return srv.ListenAndServeTLS(tlsCfg.CertFile, tlsCfg.KeyFile)
+		})
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	var err error
+	select {
+	case err = <-errs:
+	case sig := <-stop:
+		slog.Info("shutting down", "signal", sig.String())
+		stopping()
+		select {
+		case <-time.After(time.Duration(cfg.Server.DrainDelay) * time.Second):
+		case <-stop:
+		}
+	}
+
+	timeout := time.Duration(cfg.Server.ShutdownTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, s := range servers {
+		if shutdownErr := s.Shutdown(ctx); shutdownErr != nil && err == nil {
+			err = fmt.Errorf("shutting down %s: %v", s.Addr, shutdownErr)
+		}
+	}
+	return err
+}
+
+// newServer returns a server for handler on port with the configured
+// timeouts
+func newServer(cfg ServerConfig, port int, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:           fmt.Sprintf(":%d", port),
+		Handler:        handler,
+		ReadTimeout:    time.Duration(cfg.ReadTimeout) * time.Second,
+		WriteTimeout:   time.Duration(cfg.WriteTimeout) * time.Second,
+		IdleTimeout:    time.Duration(cfg.IdleTimeout) * time.Second,
+		MaxHeaderBytes: cfg.MaxHeaderBytes,
+	}
+}
+
+// redirectHTTPS sends requests to the same url over https on port
+func redirectHTTPS(port int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+		target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+	}
+}
+
+// noListing serves the files of a FileSystem without listing the contents
+// of its directories
+type noListing struct {
+	http.FileSystem
+}
+
+func (fs noListing) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err == nil && info.IsDir() {
+		err = os.ErrNotExist
+	}
 	if err != nil {
-		panic(err)
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// grantAdmins makes the users with the given emails admins, emails that
+// nobody has signed up with yet are skipped
+func grantAdmins(us models.UserService, emails []string) error {
+	for _, address := range emails {
+		user, err := us.ByEmail(address)
+		if err == models.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if user.Admin {
+			continue
+		}
+		user.Admin = true
+		if err := us.Update(user); err != nil {
+			return err
+		}
 	}
+	return nil
 }
@@ -0,0 +1,141 @@
+// Package metrics exposes what the site is doing to Prometheus.  It
+// implements models.Metrics for the services and is told about every http
+// request by middleware.Metrics.
+package metrics
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"lenslocked.com/buildinfo"
+)
+
+const namespace = "lenslocked"
+
+// New returns metrics registered along with the Go runtime and process
+// metrics and the build that is running
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "http", Name: "requests_total",
+			Help: "HTTP requests by route, method and status code.",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "http", Name: "request_duration_seconds",
+			Help:    "How long HTTP requests took by route and method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "db", Name: "query_duration_seconds",
+			Help:    "How long database queries took by operation and table.",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"operation", "table"}),
+		uploads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "images", Name: "uploads_total",
+			Help: "Images uploaded by result, success or failure.",
+		}, []string{"result"}),
+		uploadBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "images", Name: "upload_bytes_total",
+			Help: "Bytes of images uploaded successfully.",
+		}),
+		loginFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "users", Name: "login_failures_total",
+			Help: "Failed logins.",
+		}),
+	}
+	info := buildinfo.Read()
+	m.registry.MustRegister(
+		m.requests, m.requestDuration, m.queryDuration, m.uploads, m.uploadBytes, m.loginFailures,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "users", Name: "active_sessions",
+			Help: "Users who are logged in.",
+		}, m.activeSessions),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace, Name: "build_info",
+			Help:        "The build that is running, always 1.",
+			ConstLabels: prometheus.Labels{"commit": info.Commit, "go_version": info.GoVersion},
+		}, func() float64 { return 1 }),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+type Metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	queryDuration   *prometheus.HistogramVec
+	uploads         *prometheus.CounterVec
+	uploadBytes     prometheus.Counter
+	loginFailures   prometheus.Counter
+	sessions        func() (int, error)
+}
+
+// CountSessions sets how the active sessions are counted when the metrics
+// are scraped, it must be called before they are served
+func (m *Metrics) CountSessions(count func() (int, error)) {
+	m.sessions = count
+}
+
+func (m *Metrics) activeSessions() float64 {
+	if m.sessions == nil {
+		return math.NaN()
+	}
+	n, err := m.sessions()
+	if err != nil {
+		slog.Error("metrics: counting sessions", "error", err)
+		return math.NaN()
+	}
+	return float64(n)
+}
+
+// RequestDone is called by middleware.Metrics after every request
+func (m *Metrics) RequestDone(route, method string, status int, took time.Duration) {
+	m.requests.WithLabelValues(route, method, strconv.Itoa(status)).Inc()
+	m.requestDuration.WithLabelValues(route, method).Observe(took.Seconds())
+}
+
+func (m *Metrics) QueryDone(operation, table string, took time.Duration) {
+	m.queryDuration.WithLabelValues(operation, table).Observe(took.Seconds())
+}
+
+func (m *Metrics) ImageUploaded(bytes int64) {
+	m.uploads.WithLabelValues("success").Inc()
+	m.uploadBytes.Add(float64(bytes))
+}
+
+func (m *Metrics) ImageUploadFailed() {
+	m.uploads.WithLabelValues("failure").Inc()
+}
+
+func (m *Metrics) LoginFailed() {
+	m.loginFailures.Inc()
+}
+
+// Handler serves the metrics for Prometheus to scrape.  When token is set
+// only requests with it as their bearer token are answered.
+func (m *Metrics) Handler(token string) http.Handler {
+	h := promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+	if token == "" {
+		return h
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
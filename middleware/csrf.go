@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	csrfCookie = "_gorilla_csrf"
+	// csrfMaxAge is how long csrf cookies last in seconds
+	csrfMaxAge = 12 * 60 * 60
+)
+
+// CSRF protects forms from cross site request forgery.  The first of Keys
+// signs csrf cookies and the rest are previous keys that are still
+// accepted so forms opened before a key was rotated keep working until the
+// previous key is removed.  Requests with a missing or bad token are sent
+// to Failure.
+type CSRF struct {
+	Keys [][]byte
+	// Secure only sends the csrf cookie over https
+	Secure  bool
+	Failure http.Handler
+}
+
+func (mw *CSRF) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn checks every request with the newest key, cookies signed with a
+// previous key are signed again with the newest one first
+func (mw *CSRF) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	codecs := make([]*securecookie.SecureCookie, len(mw.Keys))
+	for i, key := range mw.Keys {
+		// the same settings gorilla/csrf signs its cookies with
+		codecs[i] = securecookie.New(key, nil)
+		codecs[i].SetSerializer(securecookie.JSONEncoder{})
+		codecs[i].MaxAge(csrfMaxAge)
+	}
+	protect := csrf.Protect(mw.Keys[0],
+		csrf.CookieName(csrfCookie),
+		csrf.MaxAge(csrfMaxAge),
+		csrf.Secure(mw.Secure),
+		csrf.ErrorHandler(mw.Failure),
+	)(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mw.resign(w, r, codecs)
+		protect.ServeHTTP(w, r)
+	})
+}
+
+// resign replaces a csrf cookie signed with a previous key with one signed
+// with the newest key, in the request so it is checked against the newest
+// key and in the response so the browser keeps it.  The token in the
+// cookie stays the same so forms rendered with it still match.
+func (mw *CSRF) resign(w http.ResponseWriter, r *http.Request, codecs []*securecookie.SecureCookie) {
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil {
+		return
+	}
+	var token []byte
+	if codecs[0].Decode(csrfCookie, cookie.Value, &token) == nil {
+		return
+	}
+	for _, codec := range codecs[1:] {
+		if codec.Decode(csrfCookie, cookie.Value, &token) != nil {
+			continue
+		}
+		encoded, err := codecs[0].Encode(csrfCookie, token)
+		if err != nil {
+			return
+		}
+		cookies := r.Cookies()
+		r.Header.Del("Cookie")
+		for _, c := range cookies {
+			if c.Name == csrfCookie {
+				c.Value = encoded
+			}
+			r.AddCookie(c)
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookie,
+			Value:    encoded,
+			MaxAge:   csrfMaxAge,
+			Expires:  time.Now().Add(csrfMaxAge * time.Second),
+			HttpOnly: true,
+			Secure:   mw.Secure,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return
+	}
+}
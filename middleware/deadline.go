@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"lenslocked.com/context"
+)
+
+// Deadline gives requests that move a lot of data, like gallery zip
+// downloads and imports, Timeout to finish instead of the server's read
+// and write timeouts.  A Timeout of 0 lets them take as long as they need.
+type Deadline struct {
+	Timeout time.Duration
+}
+
+func (mw *Deadline) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn moves the read and write deadlines of the connection before
+// calling next
+func (mw *Deadline) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var deadline time.Time
+		if mw.Timeout > 0 {
+			deadline = time.Now().Add(mw.Timeout)
+		}
+		rc := http.NewResponseController(w)
+		if err := rc.SetReadDeadline(deadline); err != nil {
+			context.Logger(r.Context()).Warn("extending read deadline", "error", err)
+		}
+		if err := rc.SetWriteDeadline(deadline); err != nil {
+			context.Logger(r.Context()).Warn("extending write deadline", "error", err)
+		}
+		next(w, r)
+	})
+}
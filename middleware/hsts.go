@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// HSTS tells browsers to only ever reach the site over https for MaxAge,
+// it should only be used when the site is served with TLS
+type HSTS struct {
+	MaxAge time.Duration
+}
+
+func (mw *HSTS) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn adds the Strict-Transport-Security header to every response
+func (mw *HSTS) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security",
+			fmt.Sprintf("max-age=%d; includeSubDomains", int(mw.MaxAge.Seconds())))
+		next(w, r)
+	})
+}
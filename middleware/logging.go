@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+
+	"lenslocked.com/context"
+	"lenslocked.com/rand"
+)
+
+// RequestIDHeader is where a request's id is read from when a proxy in
+// front of the site already gave it one, the id is always sent back in it
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestID keeps ids from proxies short and safe to log
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestID gives every request an id that is stored in its context so
+// everything logged while serving it can be found together
+type RequestID struct{}
+
+func (mw *RequestID) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn keeps a valid id from the request header and makes a new one
+// otherwise
+func (mw *RequestID) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			b, err := rand.Bytes(8)
+			if err != nil {
+				slog.Error("making request id", "error", err)
+			}
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next(w, r.WithContext(context.WithRequestID(r.Context(), id)))
+	})
+}
+
+// AccessLog logs every request once it has been served, it assumes that
+// RequestID middleware has already been run
+type AccessLog struct{}
+
+func (mw *AccessLog) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn logs the method, path, status, size and duration of requests,
+// server errors are logged as errors
+func (mw *AccessLog) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := newStatusWriter(w)
+		next(sw, r)
+		level := slog.LevelInfo
+		if sw.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		context.Logger(r.Context()).LogAttrs(r.Context(), level, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", sw.status),
+			slog.Int64("bytes", sw.bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote_addr", r.RemoteAddr),
+		)
+	})
+}
@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RequestObserver is told about every request, it is satisfied by
+// *metrics.Metrics
+type RequestObserver interface {
+	RequestDone(route, method string, status int, took time.Duration)
+}
+
+// Metrics tells Observer how long each request took and its status.
+// Requests are labelled with the name of the Router route they match, or
+// its path template when it has no name, so every gallery is counted
+// together.
+type Metrics struct {
+	Router   *mux.Router
+	Observer RequestObserver
+}
+
+func (mw *Metrics) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn times next and records the status it responds with
+func (mw *Metrics) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := newStatusWriter(w)
+		next(sw, r)
+		mw.Observer.RequestDone(mw.route(r), r.Method, sw.status, time.Since(start))
+	})
+}
+
+// route returns the label for the route r matches
+func (mw *Metrics) route(r *http.Request) string {
+	var match mux.RouteMatch
+	if !mw.Router.Match(r, &match) || match.Route == nil {
+		return "unmatched"
+	}
+	if name := match.Route.GetName(); name != "" {
+		return name
+	}
+	if tpl, err := match.Route.GetPathTemplate(); err == nil {
+		return tpl
+	}
+	return "unnamed"
+}
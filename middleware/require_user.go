@@ -7,8 +7,12 @@ import (
 
 	"lenslocked.com/context"
 	"lenslocked.com/models"
+	"lenslocked.com/policy"
 )
 
+// PasswordResetPath is where users who must change their password are sent
+const PasswordResetPath = "/password/reset"
+
 type User struct {
 	models.UserService
 }
@@ -18,8 +22,9 @@ func (mw *User) Apply(next http.Handler) http.HandlerFunc {
 }
 
 // ApplyFn will apply middleware to all users.  First it checks if the user is
-// fetching static images or assets which are permitted everywhere and any
-// user can load them without being looked up in the db.  Then cookies are
+// fetching static assets which are permitted everywhere and any user can
+// load them without being looked up in the db.  Images are not, who may
+// see them depends on their gallery.  Then cookies are
 // checked for all other requests by getting the remember_token value.  If the
 // cookie is expired it will redirect the next handler will be run without a user
 // being set otherwise the cookies expiration date will be set to an hour from
@@ -28,9 +33,8 @@ func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		path := r.URL.Path
 		// don't require user middleware if user is requesting
-		// static asset or image so no lookup of user is required
-		if strings.HasPrefix(path, "/assets/") ||
-			strings.HasPrefix(path, "/images/") {
+		// static assets so no lookup of user is required
+		if strings.HasPrefix(path, "/assets/") {
 			next(w, r)
 			return
 		}
@@ -41,10 +45,16 @@ func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 		}
 		cookie.Expires = time.Now().Add(time.Hour)
 		user, err := mw.ByRemember(cookie.Value)
-		if err != nil {
+		if err != nil || user.Disabled {
 			next(w, r)
 			return
 		}
+		// users an admin asked to change their password can only do
+		// that or log out until they have
+		if user.PasswordResetRequired && path != PasswordResetPath && path != "/logout" {
+			http.Redirect(w, r, PasswordResetPath, http.StatusFound)
+			return
+		}
 		ctx := r.Context()
 		ctx = context.WithUser(ctx, user)
 		r = r.WithContext(ctx)
@@ -79,3 +89,73 @@ func (mw *Owner) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 		next(w, r)
 	})
 }
+
+// Authorize assumes that User middleware has already been run.  It only
+// lets users the Policy allows to take Action through.  Visitors are sent
+// to the login page and anyone else who is not allowed gets a 403.
+// Actions on a particular resource are checked by the controllers once
+// they have looked the resource up.
+type Authorize struct {
+	Policy *policy.Policy
+	Action policy.Action
+}
+
+// Apply assumes that User middleware has already
+// been run otherwise it will not work correctly
+func (mw *Authorize) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn assumes that User middleware has already
+// been run otherwise it will not work correctly
+func (mw *Authorize) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if user == nil {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		allowed, err := mw.Policy.Can(user, mw.Action, nil)
+		if err != nil {
+			context.Logger(r.Context()).Error("checking policy", "error", err)
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// Admin assumes that User middleware has already been run.  It only lets
+// users the Policy allows to administer the site through and responds as
+// if the page does not exist to everyone else.
+type Admin struct {
+	Policy *policy.Policy
+}
+
+// Apply assumes that User middleware has already
+// been run otherwise it will not work correctly
+func (mw *Admin) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn assumes that User middleware has already
+// been run otherwise it will not work correctly
+func (mw *Admin) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, err := mw.Policy.Can(context.User(r.Context()), policy.Administer, nil)
+		if err != nil {
+			context.Logger(r.Context()).Error("checking policy", "error", err)
+			http.Error(w, "Whoops! Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			http.NotFound(w, r)
+			return
+		}
+		next(w, r)
+	})
+}
@@ -0,0 +1,138 @@
+package models
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Admin actions recorded in the audit log
+const (
+	AdminDisableUser   = "disable_user"
+	AdminEnableUser    = "enable_user"
+	AdminResetPassword = "reset_password"
+	AdminRemoveGallery = "remove_gallery"
+	AdminGrantAdmin    = "grant_admin"
+	AdminRevokeAdmin   = "revoke_admin"
+	// AdminPageSize is how many users or galleries are listed per page
+	AdminPageSize = 50
+)
+
+// UserUsage is a user along with how much they are storing
+type UserUsage struct {
+	User
+	Galleries int
+	Images    int
+	Bytes     int64
+}
+
+// GalleryUsage is a gallery along with its owner and how much it stores
+type GalleryUsage struct {
+	Gallery
+	OwnerEmail string
+	Images     int
+	Bytes      int64
+}
+
+// Storage returns how much the user is storing in a human readable form
+func (u *UserUsage) Storage() string {
+	return formatBytes(u.Bytes)
+}
+
+// Storage returns how much the gallery is storing in a human readable form
+func (g *GalleryUsage) Storage() string {
+	return formatBytes(g.Bytes)
+}
+
+// formatBytes formats n bytes with the largest unit that keeps it above 1
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// AdminService lists everything on the site for admins, what they do is
+// recorded with the AuditService
+type AdminService interface {
+	// Users returns a page of users ordered by id and how many there are
+	Users(offset, limit int) ([]UserUsage, int, error)
+	// Galleries returns a page of galleries, largest first, and how many
+	// there are
+	Galleries(offset, limit int) ([]GalleryUsage, int, error)
+}
+
+func NewAdminService(db *gorm.DB) AdminService {
+	return &adminGorm{db}
+}
+
+type adminGorm struct {
+	db *gorm.DB
+}
+
+func (ag *adminGorm) Users(offset, limit int) ([]UserUsage, int, error) {
+	var total int
+	if err := ag.db.Model(&User{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	rows, err := ag.db.Table("users").
+		Select(`users.id, users.created_at, users.name, users.email, users.admin,
+			users.disabled, users.password_reset_required,
+			COUNT(DISTINCT galleries.id), COUNT(images.id), COALESCE(SUM(images.size), 0)`).
+		Joins("LEFT JOIN galleries ON galleries.user_id = users.id AND galleries.deleted_at IS NULL").
+		Joins("LEFT JOIN images ON images.gallery_id = galleries.id AND images.deleted_at IS NULL").
+		Where("users.deleted_at IS NULL").
+		Group("users.id").Order("users.id").
+		Offset(offset).Limit(limit).Rows()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var users []UserUsage
+	for rows.Next() {
+		var u UserUsage
+		if err := rows.Scan(&u.ID, &u.CreatedAt, &u.Name, &u.Email, &u.Admin,
+			&u.Disabled, &u.PasswordResetRequired,
+			&u.Galleries, &u.Images, &u.Bytes); err != nil {
+			return nil, 0, err
+		}
+		users = append(users, u)
+	}
+	return users, total, rows.Err()
+}
+
+func (ag *adminGorm) Galleries(offset, limit int) ([]GalleryUsage, int, error) {
+	var total int
+	if err := ag.db.Model(&Gallery{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	rows, err := ag.db.Table("galleries").
+		Select(`galleries.id, galleries.user_id, galleries.title, galleries.private, galleries.updated_at,
+			users.email, COUNT(images.id), COALESCE(SUM(images.size), 0)`).
+		Joins("JOIN users ON users.id = galleries.user_id").
+		Joins("LEFT JOIN images ON images.gallery_id = galleries.id AND images.deleted_at IS NULL").
+		Where("galleries.deleted_at IS NULL").
+		Group("galleries.id, users.email").
+		Order("COALESCE(SUM(images.size), 0) DESC, galleries.id").
+		Offset(offset).Limit(limit).Rows()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var galleries []GalleryUsage
+	for rows.Next() {
+		var g GalleryUsage
+		if err := rows.Scan(&g.ID, &g.UserID, &g.Title, &g.Private, &g.UpdatedAt,
+			&g.OwnerEmail, &g.Images, &g.Bytes); err != nil {
+			return nil, 0, err
+		}
+		galleries = append(galleries, g)
+	}
+	return galleries, total, rows.Err()
+}
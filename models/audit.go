@@ -0,0 +1,225 @@
+package models
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Actions recorded in the audit log, the admin actions are recorded too
+const (
+	AuditLogin          = "login"
+	AuditLoginFailed    = "login_failed"
+	AuditLogout         = "logout"
+	AuditSignup         = "signup"
+	AuditPasswordChange = "password_change"
+	AuditGalleryCreate  = "gallery_create"
+	AuditGalleryUpdate  = "gallery_update"
+	AuditGalleryDelete  = "gallery_delete"
+	AuditImageUpload    = "image_upload"
+	AuditImageDelete    = "image_delete"
+	// AuditPageSize is how many events are listed per page
+	AuditPageSize = 50
+)
+
+// Types of targets events are about
+const (
+	TargetUser    = "user"
+	TargetGallery = "gallery"
+	TargetImage   = "image"
+)
+
+// Actor is who is doing something and where from, services bound to an
+// actor with As record it in the audit log.  The zero Actor is the site
+// itself, e.g. when run from the command line.
+type Actor struct {
+	UserID    uint
+	IP        string
+	UserAgent string
+}
+
+// AuditEvent is something a user did that we may need to answer questions
+// about later, like who deleted a gallery and when.  Events are only ever
+// added, never changed or removed.
+type AuditEvent struct {
+	ID        uint      `gorm:"primary_key"`
+	CreatedAt time.Time `gorm:"index"`
+	// ActorID is the user who did it, 0 for visitors and the site itself
+	ActorID uint   `gorm:"index"`
+	Action  string `gorm:"not null;index"`
+	// TargetType is one of the Target constants and TargetID its id
+	TargetType string `gorm:"index:idx_audit_events_target"`
+	TargetID   uint   `gorm:"index:idx_audit_events_target"`
+	// GalleryID is the gallery a gallery or image event is about, it is
+	// kept so the owner can see the event after the image is deleted
+	GalleryID uint `gorm:"index"`
+	IP        string
+	UserAgent string
+	// Details is a JSON object with anything else worth knowing, like the
+	// title of a gallery that was deleted
+	Details string `gorm:"type:text"`
+	// ActorEmail is filled in when events are listed
+	ActorEmail string `gorm:"-"`
+}
+
+// AuditFilter narrows down which events are listed, zero fields match
+// every event
+type AuditFilter struct {
+	ActorID    uint   `schema:"actor_id"`
+	Action     string `schema:"action"`
+	TargetType string `schema:"target_type"`
+	TargetID   uint   `schema:"target_id"`
+}
+
+// AuditService keeps the append-only log of what users did
+type AuditService interface {
+	// Record adds an event to the log, the actor's ip and user agent are
+	// added to it
+	Record(actor Actor, action, targetType string, targetID uint, details map[string]interface{}) error
+	// ByUserID returns a page of what a user did along with what was done
+	// to their account and galleries, by them or anyone else, newest
+	// first, and how many events there are
+	ByUserID(userID uint, offset, limit int) ([]AuditEvent, int, error)
+	// Query returns a page of the events that match filter, newest first,
+	// and how many match
+	Query(filter AuditFilter, offset, limit int) ([]AuditEvent, int, error)
+	// ActiveSessions counts the users who logged in within SessionLength
+	// and have not logged out since
+	ActiveSessions() (int, error)
+}
+
+func NewAuditService(db *gorm.DB) AuditService {
+	return &auditGorm{db}
+}
+
+// RecordEvent adds an event to audit for changes that have already been
+// made, like those of the service methods that write events, so failing
+// to record it is logged rather than returned
+func RecordEvent(audit AuditService, actor Actor, action, targetType string, targetID uint, details map[string]interface{}) {
+	if err := audit.Record(actor, action, targetType, targetID, details); err != nil {
+		slog.Error("audit: could not record event", "action", action, "target_type", targetType,
+			"target_id", targetID, "error", err)
+	}
+}
+
+type auditGorm struct {
+	db *gorm.DB
+}
+
+func (ag *auditGorm) Record(actor Actor, action, targetType string, targetID uint, details map[string]interface{}) error {
+	event := AuditEvent{
+		ActorID:    actor.UserID,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		IP:         actor.IP,
+		UserAgent:  actor.UserAgent,
+	}
+	switch targetType {
+	case TargetGallery:
+		event.GalleryID = targetID
+	case TargetImage:
+		event.GalleryID, _ = details["gallery_id"].(uint)
+	}
+	if len(details) > 0 {
+		b, err := json.Marshal(details)
+		if err != nil {
+			return err
+		}
+		event.Details = string(b)
+	}
+	return ag.db.Create(&event).Error
+}
+
+func (ag *auditGorm) ByUserID(userID uint, offset, limit int) ([]AuditEvent, int, error) {
+	db := ag.db.Model(&AuditEvent{}).
+		Where("actor_id = ? OR (target_type = ? AND target_id = ?) OR gallery_id IN ?",
+			userID, TargetUser, userID, ownedGalleries(ag.db, userID))
+	return ag.page(db, offset, limit)
+}
+
+func (ag *auditGorm) Query(filter AuditFilter, offset, limit int) ([]AuditEvent, int, error) {
+	db := ag.db.Model(&AuditEvent{})
+	if filter.ActorID != 0 {
+		db = db.Where("actor_id = ?", filter.ActorID)
+	}
+	if filter.Action != "" {
+		db = db.Where("action = ?", filter.Action)
+	}
+	if filter.TargetType != "" {
+		db = db.Where("target_type = ?", filter.TargetType)
+	}
+	if filter.TargetID != 0 {
+		db = db.Where("target_id = ?", filter.TargetID)
+	}
+	return ag.page(db, offset, limit)
+}
+
+func (ag *auditGorm) ActiveSessions() (int, error) {
+	// the latest login or logout of each user within a session's length,
+	// keyed on the user logged out as admins can do it for them
+	latest := ag.db.Model(&AuditEvent{}).Select("MAX(id)").
+		Where("action IN (?) AND created_at > ?", []string{AuditLogin, AuditLogout}, time.Now().Add(-SessionLength)).
+		Where("target_type = ?", TargetUser).
+		Group("target_id").SubQuery()
+	var n int
+	err := ag.db.Model(&AuditEvent{}).Where("id IN ?", latest).Where("action = ?", AuditLogin).Count(&n).Error
+	return n, err
+}
+
+// ownedGalleries selects the ids of a user's galleries, deleted ones
+// included as their history is still theirs
+func ownedGalleries(db *gorm.DB, userID uint) *gorm.SqlExpr {
+	return db.Unscoped().Model(&Gallery{}).Select("id").Where("user_id = ?", userID).SubQuery()
+}
+
+// backfillAuditGalleries sets GalleryID on the events recorded before it
+// was added.  Events about images that have since been deleted are left
+// as they are, nothing links them to their gallery anymore.
+func backfillAuditGalleries(db *gorm.DB) error {
+	err := db.Exec(`UPDATE audit_events SET gallery_id = target_id
+		WHERE gallery_id = 0 AND target_type = ?`, TargetGallery).Error
+	if err != nil {
+		return err
+	}
+	return db.Exec(`UPDATE audit_events SET gallery_id =
+		(SELECT gallery_id FROM images WHERE images.id = audit_events.target_id)
+		WHERE gallery_id = 0 AND target_type = ? AND target_id IN (SELECT id FROM images)`,
+		TargetImage).Error
+}
+
+// page returns a page of the events db matches, newest first, with the
+// email of each actor
+func (ag *auditGorm) page(db *gorm.DB, offset, limit int) ([]AuditEvent, int, error) {
+	var total int
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var events []AuditEvent
+	if err := db.Order("id DESC").Offset(offset).Limit(limit).Find(&events).Error; err != nil {
+		return nil, 0, err
+	}
+	ids := make([]uint, 0, len(events))
+	for _, event := range events {
+		if event.ActorID != 0 {
+			ids = append(ids, event.ActorID)
+		}
+	}
+	if len(ids) == 0 {
+		return events, total, nil
+	}
+	var actors []User
+	if err := ag.db.Unscoped().Where("id IN (?)", ids).Find(&actors).Error; err != nil {
+		return nil, 0, err
+	}
+	emails := make(map[uint]string, len(actors))
+	for _, actor := range actors {
+		emails[actor.ID] = actor.Email
+	}
+	for i := range events {
+		events[i].ActorEmail = emails[events[i].ActorID]
+	}
+	return events, total, nil
+}
@@ -0,0 +1,308 @@
+package models
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/hash"
+	"lenslocked.com/rand"
+)
+
+// Roles a user can have on a gallery.  Each role can do everything the
+// roles before it can.
+const (
+	// RoleViewer can see the gallery even when it is private
+	RoleViewer = "viewer"
+	// RoleContributor can also upload images
+	RoleContributor = "contributor"
+	// RoleEditor can also rename the gallery and edit or delete images
+	RoleEditor = "editor"
+	// RoleOwner is the user who created the gallery, it is never given
+	// to a collaborator
+	RoleOwner = "owner"
+)
+
+// roleRanks orders the roles from least to most access
+var roleRanks = map[string]int{
+	RoleViewer:      1,
+	RoleContributor: 2,
+	RoleEditor:      3,
+	RoleOwner:       4,
+}
+
+// RoleAllows reports if a user with role can do everything a user with
+// the wanted role can.  An empty role allows nothing.
+func RoleAllows(role, want string) bool {
+	return roleRanks[role] > 0 && roleRanks[role] >= roleRanks[want]
+}
+
+// Collaborator is a user invited to work on a gallery they do not own.
+// Invitations are sent by email and the collaborator only gets access
+// once a user with that email address accepts it.
+type Collaborator struct {
+	gorm.Model
+	GalleryID uint   `gorm:"not null;unique_index:idx_collaborators_gallery_email"`
+	Email     string `gorm:"not null;unique_index:idx_collaborators_gallery_email"`
+	Role      string `gorm:"not null"`
+	// UserID is the user who accepted the invitation, 0 while it is pending
+	UserID uint `gorm:"index"`
+	// Token is only set when an invitation is created, just its hash is stored
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"index"`
+}
+
+// Pending reports if the invitation has not been accepted yet
+func (c *Collaborator) Pending() bool {
+	return c.UserID == 0
+}
+
+// CollaboratorService manages who a gallery is shared with
+type CollaboratorService interface {
+	// Invite adds a collaborator to a gallery by email, inviting the same
+	// email again changes their role.  When the invitation is still
+	// pending a new token is set on the collaborator to email to them.
+	Invite(collaborator *Collaborator) error
+	// Accept gives user access to the gallery they were invited to with
+	// the token.  The invitation must have been sent to their email.
+	Accept(token string, user *User) (*Collaborator, error)
+	CollaboratorDB
+}
+
+type CollaboratorDB interface {
+	ByID(id uint) (*Collaborator, error)
+	// ByToken finds a pending invitation by its token
+	ByToken(token string) (*Collaborator, error)
+	// ByGalleryID returns everyone a gallery has been shared with
+	ByGalleryID(galleryID uint) ([]Collaborator, error)
+	// Role returns the role a user has on a gallery, it is empty when
+	// they have none
+	Role(gallery *Gallery, userID uint) (string, error)
+	// SharedWith returns the galleries other users have shared with a user
+	SharedWith(userID uint) ([]Gallery, error)
+	Create(collaborator *Collaborator) error
+	Update(collaborator *Collaborator) error
+	Delete(id uint) error
+}
+
+func NewCollaboratorService(db *gorm.DB, hmacKey string) CollaboratorService {
+	return &collaboratorService{
+		CollaboratorDB: &collaboratorValidator{
+			CollaboratorDB: &collaboratorGorm{db},
+			hmac:           hash.NewHMAC(hmacKey),
+			emailRegex:     regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
+		},
+	}
+}
+
+type collaboratorService struct {
+	CollaboratorDB
+}
+
+func (cs *collaboratorService) Invite(collaborator *Collaborator) error {
+	collaborator.Email = strings.ToLower(strings.TrimSpace(collaborator.Email))
+	existing, err := cs.ByGalleryID(collaborator.GalleryID)
+	if err != nil {
+		return err
+	}
+	for _, e := range existing {
+		if e.Email != collaborator.Email {
+			continue
+		}
+		e.Role = collaborator.Role
+		*collaborator = e
+		if !collaborator.Pending() {
+			return cs.Update(collaborator)
+		}
+		break
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	collaborator.Token = token
+	if collaborator.ID != 0 {
+		return cs.Update(collaborator)
+	}
+	return cs.Create(collaborator)
+}
+
+func (cs *collaboratorService) Accept(token string, user *User) (*Collaborator, error) {
+	collaborator, err := cs.ByToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if collaborator.Email != user.Email {
+		return nil, ErrInvitationEmail
+	}
+	collaborator.UserID = user.ID
+	collaborator.TokenHash = ""
+	if err := cs.Update(collaborator); err != nil {
+		return nil, err
+	}
+	return collaborator, nil
+}
+
+type collaboratorValidator struct {
+	CollaboratorDB
+	hmac       hash.HMAC
+	emailRegex *regexp.Regexp
+}
+
+func (cv *collaboratorValidator) ByToken(token string) (*Collaborator, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	return cv.CollaboratorDB.ByToken(cv.hmac.Hash(token))
+}
+
+func (cv *collaboratorValidator) Create(collaborator *Collaborator) error {
+	if err := runCollaboratorValFuncs(collaborator,
+		cv.normalizeEmail,
+		cv.emailFormat,
+		cv.roleValid,
+		cv.hmacToken); err != nil {
+		return err
+	}
+	return cv.CollaboratorDB.Create(collaborator)
+}
+
+func (cv *collaboratorValidator) Update(collaborator *Collaborator) error {
+	if err := runCollaboratorValFuncs(collaborator,
+		cv.normalizeEmail,
+		cv.emailFormat,
+		cv.roleValid,
+		cv.hmacToken); err != nil {
+		return err
+	}
+	return cv.CollaboratorDB.Update(collaborator)
+}
+
+func (cv *collaboratorValidator) Delete(id uint) error {
+	var collaborator Collaborator
+	collaborator.ID = id
+	if err := runCollaboratorValFuncs(&collaborator, cv.positiveID); err != nil {
+		return err
+	}
+	return cv.CollaboratorDB.Delete(id)
+}
+
+func (cv *collaboratorValidator) normalizeEmail(c *Collaborator) error {
+	c.Email = strings.ToLower(strings.TrimSpace(c.Email))
+	return nil
+}
+
+func (cv *collaboratorValidator) emailFormat(c *Collaborator) error {
+	if !cv.emailRegex.MatchString(c.Email) {
+		return ErrEmailInvalid
+	}
+	return nil
+}
+
+// roleValid only allows roles that can be given to a collaborator
+func (cv *collaboratorValidator) roleValid(c *Collaborator) error {
+	switch c.Role {
+	case RoleViewer, RoleContributor, RoleEditor:
+		return nil
+	}
+	return ErrRoleInvalid
+}
+
+func (cv *collaboratorValidator) hmacToken(c *Collaborator) error {
+	if c.Token == "" {
+		return nil
+	}
+	c.TokenHash = cv.hmac.Hash(c.Token)
+	return nil
+}
+
+func (cv *collaboratorValidator) positiveID(c *Collaborator) error {
+	if c.ID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+type collaboratorValFunc func(*Collaborator) error
+
+func runCollaboratorValFuncs(collaborator *Collaborator, fns ...collaboratorValFunc) error {
+	for _, fn := range fns {
+		if err := fn(collaborator); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ CollaboratorDB = &collaboratorGorm{}
+
+type collaboratorGorm struct {
+	db *gorm.DB
+}
+
+func (cg *collaboratorGorm) ByID(id uint) (*Collaborator, error) {
+	var collaborator Collaborator
+	db := cg.db.Where("id = ?", id)
+	err := first(db, &collaborator)
+	return &collaborator, err
+}
+
+func (cg *collaboratorGorm) ByToken(tokenHash string) (*Collaborator, error) {
+	var collaborator Collaborator
+	db := cg.db.Where("token_hash = ? AND user_id = 0", tokenHash)
+	err := first(db, &collaborator)
+	return &collaborator, err
+}
+
+func (cg *collaboratorGorm) ByGalleryID(galleryID uint) ([]Collaborator, error) {
+	var collaborators []Collaborator
+	err := cg.db.Where("gallery_id = ?", galleryID).Order("email").Find(&collaborators).Error
+	if err != nil {
+		return nil, err
+	}
+	return collaborators, nil
+}
+
+func (cg *collaboratorGorm) Role(gallery *Gallery, userID uint) (string, error) {
+	if userID == 0 {
+		return "", nil
+	}
+	if gallery.UserID == userID {
+		return RoleOwner, nil
+	}
+	var collaborator Collaborator
+	db := cg.db.Where("gallery_id = ? AND user_id = ?", gallery.ID, userID)
+	switch err := first(db, &collaborator); err {
+	case nil:
+		return collaborator.Role, nil
+	case ErrNotFound:
+		return "", nil
+	default:
+		return "", err
+	}
+}
+
+func (cg *collaboratorGorm) SharedWith(userID uint) ([]Gallery, error) {
+	var galleries []Gallery
+	err := cg.db.Select("galleries.*").
+		Joins("JOIN collaborators ON collaborators.gallery_id = galleries.id AND collaborators.deleted_at IS NULL").
+		Where("collaborators.user_id = ? AND collaborators.user_id <> 0", userID).
+		Order("galleries.title").Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+func (cg *collaboratorGorm) Create(collaborator *Collaborator) error {
+	return cg.db.Create(collaborator).Error
+}
+
+func (cg *collaboratorGorm) Update(collaborator *Collaborator) error {
+	return cg.db.Save(collaborator).Error
+}
+
+func (cg *collaboratorGorm) Delete(id uint) error {
+	collaborator := Collaborator{Model: gorm.Model{ID: id}}
+	return cg.db.Unscoped().Delete(&collaborator).Error
+}
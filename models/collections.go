@@ -0,0 +1,227 @@
+package models
+
+import "github.com/jinzhu/gorm"
+
+// MaxCollectionDepth is how deeply collections can be nested in each other
+const MaxCollectionDepth = 16
+
+// Collection groups galleries and other collections together so work can
+// be organized e.g. by client and then by event
+type Collection struct {
+	gorm.Model
+	UserID uint `gorm:"not_null;index"`
+	// ParentID is the collection this one is nested in, 0 when it is
+	// at the top level
+	ParentID uint   `gorm:"index"`
+	Title    string `gorm:"not_null"`
+	// Contents of the collection filled in for its pages
+	Collections []Collection `gorm:"-"`
+	Galleries   []Gallery    `gorm:"-"`
+	// ParentOptions are the owner's collections this one can be moved into
+	ParentOptions []Collection `gorm:"-"`
+}
+
+type CollectionService interface {
+	CollectionDB
+}
+
+type CollectionDB interface {
+	ByID(id uint) (*Collection, error)
+	// ByUserID returns every collection a user has ordered by title
+	ByUserID(userID uint) ([]Collection, error)
+	// ByParentID returns the collections nested directly in a collection,
+	// pass a parentID of 0 for a user's top level collections
+	ByParentID(userID, parentID uint) ([]Collection, error)
+	// Path returns the collection with the id along with every collection
+	// it is nested in, starting from the top level
+	Path(id uint) ([]Collection, error)
+	Create(collection *Collection) error
+	Update(collection *Collection) error
+	// Delete removes a collection, what it contains is moved up into
+	// the collection it was nested in
+	Delete(id uint) error
+}
+
+func NewCollectionService(db *gorm.DB) CollectionService {
+	return &collectionService{
+		CollectionDB: &collectionValidator{&collectionGorm{db}},
+	}
+}
+
+type collectionService struct {
+	CollectionDB
+}
+
+type collectionValidator struct {
+	CollectionDB
+}
+
+func (cv *collectionValidator) Create(collection *Collection) error {
+	if err := runCollectionValFuncs(collection,
+		cv.userIDRequired,
+		cv.titleRequired,
+		cv.parentValid); err != nil {
+		return err
+	}
+	return cv.CollectionDB.Create(collection)
+}
+
+func (cv *collectionValidator) Update(collection *Collection) error {
+	if err := runCollectionValFuncs(collection,
+		cv.userIDRequired,
+		cv.titleRequired,
+		cv.parentValid); err != nil {
+		return err
+	}
+	return cv.CollectionDB.Update(collection)
+}
+
+func (cv *collectionValidator) Delete(id uint) error {
+	var collection Collection
+	collection.ID = id
+	if err := runCollectionValFuncs(&collection, cv.positiveID); err != nil {
+		return err
+	}
+	return cv.CollectionDB.Delete(id)
+}
+
+func (cv *collectionValidator) userIDRequired(c *Collection) error {
+	if c.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (cv *collectionValidator) titleRequired(c *Collection) error {
+	if c.Title == "" {
+		return ErrCollectionTitleRequired
+	}
+	return nil
+}
+
+// parentValid makes sure a collection is only nested in another collection
+// of the same user and never ends up inside itself
+func (cv *collectionValidator) parentValid(c *Collection) error {
+	if c.ParentID == 0 {
+		return nil
+	}
+	path, err := cv.Path(c.ParentID)
+	switch err {
+	case nil:
+		break
+	case ErrNotFound:
+		return ErrCollectionParentInvalid
+	default:
+		return err
+	}
+	if len(path) >= MaxCollectionDepth {
+		return ErrCollectionTooDeep
+	}
+	for _, p := range path {
+		if p.UserID != c.UserID || (c.ID != 0 && p.ID == c.ID) {
+			return ErrCollectionParentInvalid
+		}
+	}
+	return nil
+}
+
+func (cv *collectionValidator) positiveID(c *Collection) error {
+	if c.ID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+type collectionValFunc func(*Collection) error
+
+func runCollectionValFuncs(collection *Collection, fns ...collectionValFunc) error {
+	for _, fn := range fns {
+		if err := fn(collection); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ CollectionDB = &collectionGorm{}
+
+type collectionGorm struct {
+	db *gorm.DB
+}
+
+func (cg *collectionGorm) ByID(id uint) (*Collection, error) {
+	var collection Collection
+	db := cg.db.Where("id = ?", id)
+	err := first(db, &collection)
+	return &collection, err
+}
+
+func (cg *collectionGorm) ByUserID(userID uint) ([]Collection, error) {
+	var collections []Collection
+	err := cg.db.Where("user_id = ?", userID).Order("title").Find(&collections).Error
+	if err != nil {
+		return nil, err
+	}
+	return collections, nil
+}
+
+func (cg *collectionGorm) ByParentID(userID, parentID uint) ([]Collection, error) {
+	var collections []Collection
+	err := cg.db.Where("user_id = ? AND parent_id = ?", userID, parentID).
+		Order("title").Find(&collections).Error
+	if err != nil {
+		return nil, err
+	}
+	return collections, nil
+}
+
+func (cg *collectionGorm) Path(id uint) ([]Collection, error) {
+	var path []Collection
+	for id != 0 {
+		// the depth limit also stops a corrupt loop of parents from
+		// being followed forever
+		if len(path) > MaxCollectionDepth {
+			return nil, ErrCollectionTooDeep
+		}
+		collection, err := cg.ByID(id)
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, *collection)
+		id = collection.ParentID
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path, nil
+}
+
+func (cg *collectionGorm) Create(collection *Collection) error {
+	return cg.db.Create(collection).Error
+}
+
+func (cg *collectionGorm) Update(collection *Collection) error {
+	return cg.db.Save(collection).Error
+}
+
+func (cg *collectionGorm) Delete(id uint) error {
+	collection, err := cg.ByID(id)
+	if err != nil {
+		return err
+	}
+	tx := cg.db.Begin()
+	err = tx.Model(&Collection{}).Where("parent_id = ?", id).
+		UpdateColumn("parent_id", collection.ParentID).Error
+	if err == nil {
+		err = tx.Model(&Gallery{}).Where("collection_id = ?", id).
+			UpdateColumn("collection_id", collection.ParentID).Error
+	}
+	if err == nil {
+		err = tx.Delete(&Collection{Model: gorm.Model{ID: id}}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
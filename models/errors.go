@@ -5,6 +5,8 @@ import "strings"
 const (
 	// ErrNoDBConnection is when no database connection is established
 	ErrNoDBConnection modelError = "models : no db connection found when required"
+	// ErrNoImageService is when the image service is required but has not been configured
+	ErrNoImageService modelError = "models: no image service found when required"
 	// ErrNotFound is when we cannot find a thing in our database
 	ErrNotFound modelError = "models: resource not found"
 	// ErrPasswordIncorrect describes	 when the user logs in with an incorrect passwrod
@@ -21,6 +23,40 @@ const (
 	ErrPasswordRequired modelError = "models: password is required"
 	// ErrTitleRequired describes when a gallery title is not provided on the galleries page
 	ErrTitleRequired modelError = "models: gallery title is required"
+	// ErrSortModeInvalid describes when a gallery is given a sort mode that does not exist
+	ErrSortModeInvalid modelError = "models: gallery sort mode is not valid"
+	// ErrFilenameInvalid describes when an uploaded image has a filename that cannot be stored
+	ErrFilenameInvalid modelError = "models: image filename is not valid"
+	// ErrUploadSize describes when an upload is empty or larger than MaxUploadSize
+	ErrUploadSize modelError = "models: image must be between 1 byte and 100 megabytes"
+	// ErrUploadOffset describes when a chunk does not start where the upload left off
+	ErrUploadOffset modelError = "models: upload chunk does not start at the current offset"
+	// ErrImageType describes when an uploaded file is not a jpg, jpeg or png image
+	ErrImageType modelError = "models: images must be jpg, jpeg or png files"
+	// ErrZipInvalid describes when an uploaded archive or one of its entries cannot be read
+	ErrZipInvalid modelError = "models: zip archive is invalid or corrupt"
+	// ErrZipTooLarge describes when an uploaded archive has too many entries or bytes to extract
+	ErrZipTooLarge modelError = "models: zip archive has too many or too large files to import"
+	// ErrImageTextTooLong describes when an image title, alt text or caption is too long
+	ErrImageTextTooLong modelError = "models: image titles are limited to 200, alt texts to 500 and captions to 2000 characters"
+	// ErrRenditionInvalid describes when an image is requested in a rendition that does not exist
+	ErrRenditionInvalid modelError = "models: image rendition is not valid"
+	// ErrCollectionTitleRequired describes when a collection title is not provided
+	ErrCollectionTitleRequired modelError = "models: collection title is required"
+	// ErrCollectionParentInvalid describes when a collection is moved into a collection it cannot be nested in
+	ErrCollectionParentInvalid modelError = "models: collection cannot be moved there"
+	// ErrCollectionTooDeep describes when collections are nested deeper than MaxCollectionDepth
+	ErrCollectionTooDeep modelError = "models: collections cannot be nested more than 16 levels deep"
+	// ErrTagInvalid describes when a tag is too long or has characters other than letters, numbers, spaces and dashes
+	ErrTagInvalid modelError = "models: tags can only have letters, numbers, spaces and dashes and be up to 50 characters"
+	// ErrTooManyTags describes when a gallery or image is given more than MaxTags tags
+	ErrTooManyTags modelError = "models: galleries and images can have at most 30 tags"
+	// ErrRoleInvalid describes when a collaborator is given a role that does not exist
+	ErrRoleInvalid modelError = "models: collaborators can only be viewers, contributors or editors"
+	// ErrInvitationEmail describes when an invitation is accepted by a user with a different email
+	ErrInvitationEmail modelError = "models: this invitation was sent to a different email address"
+	// ErrAccountDisabled describes when a disabled user tries to log in
+	ErrAccountDisabled modelError = "models: this account has been disabled"
 	// ErrRememberTooShort describes when a remember token is not at least 32 bytes
 	ErrRememberTooShort privateError = "models: remember token must be 32 bytes"
 	// ErrRememberRequired describes when a remember token is not provided
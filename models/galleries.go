@@ -1,13 +1,87 @@
 package models
 
-import "github.com/jinzhu/gorm"
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
 
 // Gallery represents that image resources that visitors view
 type Gallery struct {
 	gorm.Model
-	UserID uint    `gorm:"not_null;index"`
-	Title  string  `gorm:"not_null"`
-	Images []Image `gorm:"-"`
+	UserID uint   `gorm:"not_null;index"`
+	Title  string `gorm:"not_null"`
+	// KeepGPS serves images with the location they were taken at,
+	// by default it is stripped from everything visitors can see
+	KeepGPS bool
+	// Private galleries are only listed and shown to their owner
+	Private bool
+	// SortMode is the order the gallery's images are shown in
+	SortMode string
+	// CoverImageID is the image chosen to represent the gallery, when it
+	// is not set the first image of the gallery is used instead
+	CoverImageID uint
+	// CollectionID is the collection the gallery is in, 0 when it is not
+	// in one
+	CollectionID uint     `gorm:"index"`
+	Tags         []string `gorm:"-"`
+	Images       []Image  `gorm:"-"`
+	// Summary of the gallery's images filled in by ImageService.Summarize
+	Cover       *Image    `gorm:"-"`
+	ImageCount  int       `gorm:"-"`
+	LastUpdated time.Time `gorm:"-"`
+	// ImagePage is the page of images that Images holds
+	ImagePage int `gorm:"-"`
+	// CollectionOptions are the owner's collections the gallery can be
+	// moved into
+	CollectionOptions []Collection `gorm:"-"`
+	// Role is the current user's role on the gallery and Collaborators
+	// everyone it is shared with, filled in for the gallery's pages
+	Role          string         `gorm:"-"`
+	Collaborators []Collaborator `gorm:"-"`
+}
+
+// visibleGallery is the condition for galleries a viewer can see, which
+// are the public ones, their own and those shared with them.  Its
+// arguments are false followed by the viewer's id twice.
+const visibleGallery = `(galleries.private = ? OR galleries.user_id = ? OR EXISTS
+	(SELECT 1 FROM collaborators WHERE collaborators.gallery_id = galleries.id
+	AND collaborators.user_id = ? AND collaborators.user_id <> 0
+	AND collaborators.deleted_at IS NULL))`
+
+const (
+	// GalleryPageSize is how many galleries are listed per page
+	GalleryPageSize = 24
+	// ImagePageSize is how many of a gallery's images are shown per page
+	ImagePageSize = 60
+)
+
+const (
+	// SortCustom shows images in the order the owner arranged them
+	SortCustom = ""
+	// SortTaken shows images by the date they were taken, images
+	// without a date taken come last
+	SortTaken = "taken"
+	// SortUploaded shows images in the order they were uploaded
+	SortUploaded = "uploaded"
+	// SortFilename shows images alphabetically by filename
+	SortFilename = "filename"
+)
+
+// SortOption is a sort mode along with the name it is shown to users as
+type SortOption struct {
+	Mode     string
+	Name     string
+	Selected bool
+}
+
+// SortModes lists every sort mode a gallery can have
+var SortModes = []SortOption{
+	{Mode: SortCustom, Name: "Custom"},
+	{Mode: SortTaken, Name: "Date taken"},
+	{Mode: SortUploaded, Name: "Upload time"},
+	{Mode: SortFilename, Name: "Filename"},
 }
 
 func (g *Gallery) ImagesSplitN(n int) [][]Image {
@@ -22,13 +96,63 @@ func (g *Gallery) ImagesSplitN(n int) [][]Image {
 	return result
 }
 
+// SortOptions returns every sort mode with the gallery's marked selected
+func (g *Gallery) SortOptions() []SortOption {
+	options := make([]SortOption, len(SortModes))
+	for i, sm := range SortModes {
+		options[i] = sm
+		options[i].Selected = sm.Mode == g.SortMode
+	}
+	return options
+}
+
+// TagList returns the gallery's tags as they are typed into a form
+func (g *Gallery) TagList() string {
+	return strings.Join(g.Tags, ", ")
+}
+
+// VisibleTo reports if the user with the id can see the gallery without
+// being a collaborator, pass 0 for visitors who are not logged in
+func (g *Gallery) VisibleTo(userID uint) bool {
+	return !g.Private || (userID != 0 && g.UserID == userID)
+}
+
+// CanUpload, CanEdit and CanManage report what the current user's Role
+// lets them do with the gallery
+func (g *Gallery) CanUpload() bool { return RoleAllows(g.Role, RoleContributor) }
+func (g *Gallery) CanEdit() bool   { return RoleAllows(g.Role, RoleEditor) }
+func (g *Gallery) CanManage() bool { return RoleAllows(g.Role, RoleOwner) }
+
+// CustomSort reports if the gallery's images are shown in the order
+// its owner arranged them
+func (g *Gallery) CustomSort() bool {
+	return g.SortMode == SortCustom
+}
+
 type GalleryService interface {
+	// As returns the service acting for actor, galleries they create,
+	// update and delete are recorded in the audit log
+	As(actor Actor) GalleryService
 	GalleryDB
 }
 
 type GalleryDB interface {
 	ByID(id uint) (*Gallery, error)
-	ByUserID(userID uint) ([]Gallery, error)
+	// ByUserID returns up to limit of a user's galleries that come after
+	// the cursor along with the cursor for the next page, which is 0 when
+	// there are no more galleries.  Pass a cursor of 0 for the first page.
+	ByUserID(userID uint, limit int, cursor uint) ([]Gallery, uint, error)
+	// ByCollectionID returns the galleries in a collection that the user
+	// with viewerID can see, pass 0 for visitors who are not logged in
+	ByCollectionID(collectionID, viewerID uint) ([]Gallery, error)
+	// ByTag returns the galleries with a tag that the user with viewerID
+	// can see, pass 0 for visitors who are not logged in
+	ByTag(tag string, viewerID uint) ([]Gallery, error)
+	// TagsByPrefix returns up to limit of the tags a user has put on their
+	// galleries and images that start with prefix
+	TagsByPrefix(userID uint, prefix string, limit int) ([]string, error)
+	// SetTags replaces the gallery's tags with gallery.Tags
+	SetTags(gallery *Gallery) error
 	Create(gallery *Gallery) error
 	Update(gallery *Gallery) error
 	Delete(id uint) error
@@ -37,11 +161,51 @@ type GalleryDB interface {
 func NewGalleryService(db *gorm.DB) GalleryService {
 	return &galleryService{
 		GalleryDB: &galleryValidator{&galleryGorm{db}},
+		audit:     NewAuditService(db),
 	}
 }
 
 type galleryService struct {
 	GalleryDB
+	audit AuditService
+	actor Actor
+}
+
+func (gs *galleryService) As(actor Actor) GalleryService {
+	bound := *gs
+	bound.actor = actor
+	return &bound
+}
+
+func (gs *galleryService) Create(gallery *Gallery) error {
+	if err := gs.GalleryDB.Create(gallery); err != nil {
+		return err
+	}
+	RecordEvent(gs.audit, gs.actor, AuditGalleryCreate, TargetGallery, gallery.ID,
+		map[string]interface{}{"title": gallery.Title, "owner_id": gallery.UserID})
+	return nil
+}
+
+func (gs *galleryService) Update(gallery *Gallery) error {
+	if err := gs.GalleryDB.Update(gallery); err != nil {
+		return err
+	}
+	RecordEvent(gs.audit, gs.actor, AuditGalleryUpdate, TargetGallery, gallery.ID,
+		map[string]interface{}{"title": gallery.Title, "private": gallery.Private, "collection_id": gallery.CollectionID})
+	return nil
+}
+
+func (gs *galleryService) Delete(id uint) error {
+	gallery, err := gs.GalleryDB.ByID(id)
+	if err != nil {
+		return err
+	}
+	if err := gs.GalleryDB.Delete(id); err != nil {
+		return err
+	}
+	RecordEvent(gs.audit, gs.actor, AuditGalleryDelete, TargetGallery, id,
+		map[string]interface{}{"title": gallery.Title, "owner_id": gallery.UserID})
+	return nil
 }
 
 type galleryValidator struct {
@@ -60,12 +224,22 @@ func (gv *galleryValidator) Create(gallery *Gallery) error {
 func (gv *galleryValidator) Update(gallery *Gallery) error {
 	if err := runGalleryValFuncs(gallery,
 		gv.userIDRequired,
-		gv.titleRequired); err != nil {
+		gv.titleRequired,
+		gv.sortModeValid); err != nil {
 		return err
 	}
 	return gv.GalleryDB.Update(gallery)
 }
 
+func (gv *galleryValidator) SetTags(gallery *Gallery) error {
+	if err := runGalleryValFuncs(gallery,
+		gv.positiveID,
+		gv.tagsValid); err != nil {
+		return err
+	}
+	return gv.GalleryDB.SetTags(gallery)
+}
+
 func (gv *galleryValidator) Delete(id uint) error {
 	var gallery Gallery
 	gallery.ID = id
@@ -89,6 +263,24 @@ func (gv *galleryValidator) titleRequired(g *Gallery) error {
 	return nil
 }
 
+func (gv *galleryValidator) sortModeValid(g *Gallery) error {
+	for _, sm := range SortModes {
+		if g.SortMode == sm.Mode {
+			return nil
+		}
+	}
+	return ErrSortModeInvalid
+}
+
+func (gv *galleryValidator) tagsValid(g *Gallery) error {
+	tags, err := normalizeTags(g.Tags)
+	if err != nil {
+		return err
+	}
+	g.Tags = tags
+	return nil
+}
+
 func (gv *galleryValidator) positiveID(g *Gallery) error {
 	if g.ID <= 0 {
 		return ErrIDInvalid
@@ -116,18 +308,78 @@ type galleryGorm struct {
 func (gg *galleryGorm) ByID(id uint) (*Gallery, error) {
 	var gallery Gallery
 	db := gg.db.Where("id = ?", id)
-	err := first(db, &gallery)
+	if err := first(db, &gallery); err != nil {
+		return &gallery, err
+	}
+	tags, err := tagNames(gg.db, "gallery_tags", "gallery_id", []uint{id})
+	gallery.Tags = tags[id]
 	return &gallery, err
 }
 
-func (gg *galleryGorm) ByUserID(userID uint) ([]Gallery, error) {
+func (gg *galleryGorm) ByUserID(userID uint, limit int, cursor uint) ([]Gallery, uint, error) {
 	var galleries []Gallery
-	if err := gg.db.Where("user_id = ?", userID).Find(&galleries).Error; err != nil {
+	// one extra gallery is loaded to find out if there is a next page
+	err := gg.db.Where("user_id = ? AND id > ?", userID, cursor).
+		Order("id").Limit(limit + 1).Find(&galleries).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(galleries) <= limit {
+		return galleries, 0, nil
+	}
+	galleries = galleries[:limit]
+	return galleries, galleries[limit-1].ID, nil
+}
+
+func (gg *galleryGorm) ByCollectionID(collectionID, viewerID uint) ([]Gallery, error) {
+	var galleries []Gallery
+	err := gg.db.Where("collection_id = ?", collectionID).
+		Where(visibleGallery, false, viewerID, viewerID).
+		Order("title").Find(&galleries).Error
+	if err != nil {
 		return nil, err
 	}
 	return galleries, nil
 }
 
+func (gg *galleryGorm) ByTag(tag string, viewerID uint) ([]Gallery, error) {
+	var galleries []Gallery
+	err := gg.db.Select("galleries.*").
+		Joins("JOIN gallery_tags ON gallery_tags.gallery_id = galleries.id").
+		Joins("JOIN tags ON tags.id = gallery_tags.tag_id").
+		Where("tags.name = ?", NormalizeTag(tag)).
+		Where(visibleGallery, false, viewerID, viewerID).
+		Order("galleries.title").Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+func (gg *galleryGorm) TagsByPrefix(userID uint, prefix string, limit int) ([]string, error) {
+	var tags []string
+	err := gg.db.Table("tags").
+		Where("tags.name LIKE ?", likePrefix(NormalizeTag(prefix))).
+		Where(`EXISTS (SELECT 1 FROM gallery_tags
+			JOIN galleries ON galleries.id = gallery_tags.gallery_id
+			WHERE gallery_tags.tag_id = tags.id AND galleries.user_id = ?
+			AND galleries.deleted_at IS NULL)
+		OR EXISTS (SELECT 1 FROM image_tags
+			JOIN images ON images.id = image_tags.image_id
+			JOIN galleries ON galleries.id = images.gallery_id
+			WHERE image_tags.tag_id = tags.id AND galleries.user_id = ?
+			AND galleries.deleted_at IS NULL)`, userID, userID).
+		Order("tags.name").Limit(limit).Pluck("tags.name", &tags).Error
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func (gg *galleryGorm) SetTags(gallery *Gallery) error {
+	return setTags(gg.db, "gallery_tags", "gallery_id", gallery.ID, gallery.Tags)
+}
+
 func (gg *galleryGorm) Create(gallery *Gallery) error {
 	return gg.db.Create(gallery).Error
 }
@@ -0,0 +1,136 @@
+package models
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// garbageMinAge is how long files and directories must have gone unchanged
+// before CollectGarbage removes them.  Uploads still being written and
+// galleries created while it runs are newer than this so they are left
+// alone.
+const garbageMinAge = 24 * time.Hour
+
+// GarbageReport is what CollectGarbage removed, or would have removed on a
+// dry run
+type GarbageReport struct {
+	// Paths are the files and directories on disk
+	Paths []string
+	// Images is how many image records of galleries deleted at least
+	// garbageMinAge ago there were
+	Images int
+}
+
+// CollectGarbage removes what deleted galleries and interrupted uploads
+// leave behind: the images of galleries that no longer exist, both their
+// files and db records, temp files of uploads that never finished and the
+// part files of resumable uploads that are gone.  Only files and
+// directories unchanged for garbageMinAge and the records of galleries
+// deleted at least that long ago are removed so it is safe to run while
+// the site is up.  Nothing is removed when dryRun is set.
+func (s *Services) CollectGarbage(dryRun bool) (*GarbageReport, error) {
+	report := &GarbageReport{}
+	cutoff := time.Now().Add(-garbageMinAge)
+	removeStale := func(path string, dir bool) error {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			return nil
+		}
+		report.Paths = append(report.Paths, path)
+		if dryRun {
+			return nil
+		}
+		if dir {
+			return os.RemoveAll(path)
+		}
+		return os.Remove(path)
+	}
+
+	var galleryIDs []uint
+	if err := s.db.Model(&Gallery{}).Pluck("id", &galleryIDs).Error; err != nil {
+		return nil, err
+	}
+	galleries := make(map[uint64]bool, len(galleryIDs))
+	for _, id := range galleryIDs {
+		galleries[uint64(id)] = true
+	}
+	for _, root := range []string{imageRootDir, originalRootDir} {
+		dirs, err := filepath.Glob(root + "*")
+		if err != nil {
+			return nil, err
+		}
+		for _, dir := range dirs {
+			id, err := strconv.ParseUint(filepath.Base(dir), 10, 64)
+			if err != nil {
+				continue
+			}
+			if !galleries[id] {
+				if err := removeStale(dir, true); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			tmps, err := filepath.Glob(filepath.Join(dir, tmpImagePrefix+"*"))
+			if err != nil {
+				return nil, err
+			}
+			for _, tmp := range tmps {
+				if err := removeStale(tmp, false); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	var uploadIDs []uint
+	if err := s.db.Model(&Upload{}).Pluck("id", &uploadIDs).Error; err != nil {
+		return nil, err
+	}
+	uploads := make(map[uint64]bool, len(uploadIDs))
+	for _, id := range uploadIDs {
+		uploads[uint64(id)] = true
+	}
+	parts, err := filepath.Glob(uploadDir + "*.part")
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range parts {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(part), ".part"), 10, 64)
+		if err == nil && uploads[id] {
+			continue
+		}
+		if err := removeStale(part, false); err != nil {
+			return nil, err
+		}
+	}
+
+	// records are kept until their gallery has been deleted for as long as
+	// files are, a gallery deleted just now may still be getting uploads
+	kept := s.db.Unscoped().Model(&Gallery{}).Select("id").
+		Where("deleted_at IS NULL OR deleted_at > ?", cutoff).SubQuery()
+	orphans := s.db.Unscoped().Model(&Image{}).Where("gallery_id NOT IN ?", kept)
+	if err := orphans.Count(&report.Images).Error; err != nil {
+		return nil, err
+	}
+	if dryRun || report.Images == 0 {
+		return report, nil
+	}
+	err = s.db.Exec(`DELETE FROM image_tags WHERE image_id IN
+		(SELECT id FROM images WHERE gallery_id NOT IN ?)`, kept).Error
+	if err != nil {
+		return nil, err
+	}
+	if err := orphans.Delete(&Image{}).Error; err != nil {
+		return nil, err
+	}
+	return report, nil
+}
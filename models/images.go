@@ -1,17 +1,140 @@
 package models
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"image/jpeg"
 	"io"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/exif"
+)
+
+const (
+	// imageRootDir is the directory all gallery images are served from
+	imageRootDir = "images/galleries/"
+	// originalRootDir keeps images exactly as they were uploaded.  It must
+	// not be under images/ as originals may still contain a location.
+	originalRootDir = "originals/galleries/"
+	// RenditionOriginal is the image exactly as it was uploaded
+	RenditionOriginal = "original"
+	// RenditionWeb is the image as it is served in galleries, rotated
+	// upright and without its location unless the gallery keeps it
+	RenditionWeb = "web"
+	// MaxImageTitle, MaxImageAltText and MaxImageCaption are the longest
+	// texts in bytes that can be saved with an image
+	MaxImageTitle   = 200
+	MaxImageAltText = 500
+	MaxImageCaption = 2000
+	// webJPEGQuality is used when a jpg has to be re-encoded to rotate it
+	webJPEGQuality = 92
+	// tmpImagePrefix is prepended to the temp files that uploads are
+	// written to before being renamed into place
+	tmpImagePrefix = ".upload-"
 )
 
-// Image is not stored in the db
+// Image is stored in the file system under its gallery's directory while
+// its metadata (size, checksum and EXIF fields) is stored in the db
 type Image struct {
-	GalleryID uint
-	Filename  string
+	gorm.Model
+	GalleryID uint   `gorm:"not null;unique_index:idx_images_gallery_filename"`
+	Filename  string `gorm:"not null;unique_index:idx_images_gallery_filename"`
+	Size      int64
+	Checksum  string
+	// Position is where the image is placed in its gallery's custom order
+	Position int `gorm:"not null;default:0"`
+	// Text shown alongside the image, AltText describes the image for
+	// visitors who cannot see it
+	Title   string
+	Caption string `gorm:"type:text"`
+	AltText string
+	Tags    []string `gorm:"-"`
+	// EXIF metadata, only ever set for jpgs
+	CameraMake   string
+	CameraModel  string
+	LensModel    string
+	ExposureTime string
+	FNumber      float64
+	ISO          int
+	FocalLength  float64
+	TakenAt      *time.Time
+	Orientation  int
+	Latitude     *float64
+	Longitude    *float64
+}
+
+// TagList returns the image's tags as they are typed into a form
+func (i *Image) TagList() string {
+	return strings.Join(i.Tags, ", ")
+}
+
+// Alt returns the text to use as the image's alt attribute falling back
+// to its title and then its filename when no alt text has been written
+func (i *Image) Alt() string {
+	switch {
+	case i.AltText != "":
+		return i.AltText
+	case i.Title != "":
+		return i.Title
+	default:
+		return i.Filename
+	}
+}
+
+// Camera returns the make and model of the camera that took the image
+func (i *Image) Camera() string {
+	if strings.HasPrefix(strings.ToLower(i.CameraModel), strings.ToLower(i.CameraMake)) {
+		return i.CameraModel
+	}
+	return strings.TrimSpace(i.CameraMake + " " + i.CameraModel)
+}
+
+// Exposure returns the exposure settings of the image as photographers
+// write them i.e. "50mm f/1.8 1/250s ISO 400"
+func (i *Image) Exposure() string {
+	var parts []string
+	if i.FocalLength > 0 {
+		parts = append(parts, strconv.FormatFloat(i.FocalLength, 'f', -1, 64)+"mm")
+	}
+	if i.FNumber > 0 {
+		parts = append(parts, "f/"+strconv.FormatFloat(i.FNumber, 'f', -1, 64))
+	}
+	if i.ExposureTime != "" {
+		parts = append(parts, i.ExposureTime+"s")
+	}
+	if i.ISO > 0 {
+		parts = append(parts, "ISO "+strconv.Itoa(i.ISO))
+	}
+	return strings.Join(parts, " ")
+}
+
+// setExif copies the useful fields of an image's EXIF metadata
+func (i *Image) setExif(info *exif.Info) {
+	i.CameraMake = info.Make
+	i.CameraModel = info.Model
+	i.LensModel = info.LensModel
+	i.ExposureTime = info.ExposureTime
+	i.FNumber = info.FNumber
+	i.ISO = info.ISO
+	i.FocalLength = info.FocalLength
+	i.TakenAt = info.TakenAt
+	i.Orientation = info.Orientation
+	if info.HasGPS {
+		i.Latitude = &info.Latitude
+		i.Longitude = &info.Longitude
+	}
 }
 
 // RelPath returns the relative filepath to the associated image in the file system
@@ -25,58 +148,551 @@ func (i *Image) RelPath() string {
 // RootPath returns the path starting at the root of the lenslocked project
 // to the associated image in the file system
 func (i *Image) RootPath() string {
-	return fmt.Sprintf("images/galleries/%d/%s", i.GalleryID, i.Filename)
+	return fmt.Sprintf("%s%d/%s", imageRootDir, i.GalleryID, i.Filename)
+}
+
+// originalPath returns the path to the image as it was uploaded
+func (i *Image) originalPath() string {
+	return fmt.Sprintf("%s%d/%s", originalRootDir, i.GalleryID, i.Filename)
 }
 
 type ImageService interface {
-	Create(img *Image, r io.ReadCloser) error
+	// Create writes the contents of r to the gallery's directory.  The
+	// image is only visible once it has been completely written, if the
+	// copy fails or ctx is cancelled the partial upload is removed.
+	Create(ctx context.Context, img *Image, r io.ReadCloser) error
+	// ImportZip creates an image for every permitted image in a zip
+	// archive and reports which entries were skipped
+	ImportZip(ctx context.Context, galleryID uint, r io.ReaderAt, size int64) (*ZipImport, error)
+	// ByFilename returns the image of a gallery with the given filename
+	ByFilename(galleryID uint, filename string) (*Image, error)
+	// Update saves the title, caption and alt text of an image
+	Update(img *Image) error
+	// ByGalleryID returns a gallery's images in their custom order
 	ByGalleryID(galleryID uint) ([]Image, error)
+	// ByGallery returns a gallery's images in the gallery's sort mode
+	ByGallery(gallery *Gallery) ([]Image, error)
+	// PageByGallery returns limit of a gallery's images in the gallery's
+	// sort mode starting at offset along with how many images it has
+	PageByGallery(gallery *Gallery, offset, limit int) ([]Image, int, error)
+	// PageByTag returns limit of the images with a tag that the user with
+	// viewerID can see starting at offset along with how many there are
+	PageByTag(tag string, viewerID uint, offset, limit int) ([]Image, int, error)
+	// SetTags replaces the image's tags with img.Tags
+	SetTags(img *Image) error
+	// Reorder rearranges the listed images of a gallery into the order of
+	// filenames using the places in the custom order they already held.
+	// Images that are not listed stay where they are.
+	Reorder(galleryID uint, filenames []string) error
+	// Summarize fills in the cover, image count and last updated time of
+	// every gallery with a fixed number of queries however many there are
+	Summarize(galleries []Gallery) error
+	// Rerender writes the served copies of a gallery's images again from
+	// their originals e.g. after the gallery's KeepGPS setting changed
+	Rerender(ctx context.Context, galleryID uint) error
+	// Open returns the contents of the given rendition of an image
+	Open(img *Image, rendition string) (io.ReadCloser, error)
 	Delete(img *Image) error
+	// As returns the service acting for actor, images they upload and
+	// delete are recorded in the audit log
+	As(actor Actor) ImageService
 }
 
-func NewImageService() ImageService {
-	return &imageService{}
+// NewImageService returns the service for images, uploads are counted in
+// m which may be nil
+func NewImageService(db *gorm.DB, m Metrics) ImageService {
+	return &imageService{db: db, audit: NewAuditService(db), metrics: orNoMetrics(m)}
 }
 
-type imageService struct{}
+type imageService struct {
+	db      *gorm.DB
+	audit   AuditService
+	actor   Actor
+	metrics Metrics
+}
+
+func (is *imageService) As(actor Actor) ImageService {
+	bound := *is
+	bound.actor = actor
+	return &bound
+}
+
+func (is *imageService) Create(ctx context.Context, img *Image, r io.ReadCloser) error {
+	if err := is.create(ctx, img, r); err != nil {
+		is.metrics.ImageUploadFailed()
+		return err
+	}
+	is.metrics.ImageUploaded(img.Size)
+	return nil
+}
 
-func (is *imageService) Create(img *Image, r io.ReadCloser) error {
+// create writes the uploaded image and its rendition to disk and saves it
+func (is *imageService) create(ctx context.Context, img *Image, r io.ReadCloser) error {
 	defer r.Close()
-	path, err := is.mkImagePath(img.GalleryID)
+	img.Filename = filepath.Base(img.Filename)
+	if img.Filename == "." || img.Filename == "/" || strings.HasPrefix(img.Filename, ".") {
+		return ErrFilenameInvalid
+	}
+	br := bufio.NewReader(r)
+	if err := checkImageType(img.Filename, br); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(img.originalPath()), 0755); err != nil {
+		return err
+	}
+	// both files are written under temp names and only moved into place
+	// once the image is saved, so a failed upload over an existing image
+	// leaves that image as it was
+	original, err := stagingPath(img.originalPath())
 	if err != nil {
 		return err
 	}
-	dst, err := os.Create(path + img.Filename)
+	defer os.Remove(original)
+	size, checksum, err := writeFileAtomic(ctx, original, &maxReader{r: br, n: MaxUploadSize})
 	if err != nil {
 		return err
 	}
-	defer dst.Close()
-	_, err = io.Copy(dst, r)
+	img.Size = size
+	img.Checksum = checksum
+	if _, err := is.mkImagePath(img.GalleryID); err != nil {
+		return err
+	}
+	rendition, err := stagingPath(img.RootPath())
 	if err != nil {
 		return err
 	}
+	defer os.Remove(rendition)
+	if err := is.renderTo(ctx, img, original, rendition); err != nil {
+		return err
+	}
+	if err := is.save(img); err != nil {
+		return err
+	}
+	if err := os.Rename(original, img.originalPath()); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(img.originalPath()))
+	if err := os.Rename(rendition, img.RootPath()); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(img.RootPath()))
+	RecordEvent(is.audit, is.actor, AuditImageUpload, TargetImage, img.ID,
+		map[string]interface{}{"gallery_id": img.GalleryID, "filename": img.Filename, "size": img.Size})
 	return nil
 }
 
-func (is *imageService) ByGalleryID(galleryID uint) ([]Image, error) {
-	path := is.imagePath(galleryID)
-	paths, err := filepath.Glob(path + "*")
+// render writes the copy of an image that is served in its gallery.  The
+// EXIF metadata of jpgs is read into img, then they are rotated upright and
+// have their location stripped unless the gallery is set to keep it.
+// Images that need none of that are hard linked to their original.
+func (is *imageService) render(ctx context.Context, img *Image) error {
+	path, err := is.mkImagePath(img.GalleryID)
+	if err != nil {
+		return err
+	}
+	return is.renderTo(ctx, img, img.originalPath(), path+img.Filename)
+}
+
+// renderTo is render reading the original from src and writing to dst
+func (is *imageService) renderTo(ctx context.Context, img *Image, src, dst string) error {
+	if permittedTypes[strings.ToLower(filepath.Ext(img.Filename))] != "image/jpeg" {
+		return linkFileAtomic(ctx, src, dst)
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	info, err := exif.Read(bytes.NewReader(data))
+	if err != nil {
+		info = &exif.Info{}
+	}
+	img.setExif(info)
+	if info.Orientation > 1 {
+		// re-encoding drops all metadata, location included
+		data, err = rotateJPEG(data, info.Orientation)
+		if err != nil {
+			return err
+		}
+		_, _, err = writeFileAtomic(ctx, dst, bytes.NewReader(data))
+		return err
+	}
+	if is.keepsGPS(img.GalleryID) {
+		return linkFileAtomic(ctx, src, dst)
+	}
+	stripped, err := exif.StripGPS(data)
+	if err != nil {
+		// metadata that cannot be parsed cannot be trusted to not
+		// contain a location so it is dropped by re-encoding instead
+		if stripped, err = rotateJPEG(data, 1); err != nil {
+			return err
+		}
+	}
+	_, _, err = writeFileAtomic(ctx, dst, bytes.NewReader(stripped))
+	return err
+}
+
+// keepsGPS reports if a gallery serves its images with their location
+func (is *imageService) keepsGPS(galleryID uint) bool {
+	var gallery Gallery
+	db := is.db.Select("keep_gps").Where("id = ?", galleryID)
+	if err := first(db, &gallery); err != nil {
+		return false
+	}
+	return gallery.KeepGPS
+}
+
+// rotateJPEG decodes a jpg, transforms it to display upright given its
+// EXIF orientation and encodes it again
+func rotateJPEG(data []byte, orientation int) ([]byte, error) {
+	src, err := jpeg.Decode(bytes.NewReader(data))
 	if err != nil {
 		return nil, err
 	}
-	images := make([]Image, len(paths))
-	for i := range paths {
-		images[i].Filename = filepath.Base(paths[i])
-		images[i].GalleryID = galleryID
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, exif.Orient(src, orientation), &jpeg.Options{Quality: webJPEGQuality})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// save creates or updates the db record for an image that was just
+// written, an upload with an existing filename replaces that image
+func (is *imageService) save(img *Image) error {
+	var existing Image
+	db := is.db.Where("gallery_id = ? AND filename = ?", img.GalleryID, img.Filename)
+	switch err := first(db, &existing); err {
+	case ErrNotFound:
+		// new images are added to the end of the custom order
+		var last int
+		row := is.db.Model(&Image{}).Where("gallery_id = ?", img.GalleryID).
+			Select("COALESCE(MAX(position), 0)").Row()
+		if err := row.Scan(&last); err != nil {
+			return err
+		}
+		img.Position = last + 1
+		return is.db.Create(img).Error
+	case nil:
+		img.Model = existing.Model
+		img.Position = existing.Position
+		img.Title = existing.Title
+		img.Caption = existing.Caption
+		img.AltText = existing.AltText
+		return is.db.Save(img).Error
+	default:
+		return err
+	}
+}
+
+func (is *imageService) ByFilename(galleryID uint, filename string) (*Image, error) {
+	var img Image
+	db := is.db.Where("gallery_id = ? AND filename = ?", galleryID, filename)
+	err := first(db, &img)
+	return &img, err
+}
+
+func (is *imageService) Update(img *Image) error {
+	img.Title = strings.TrimSpace(img.Title)
+	img.Caption = strings.TrimSpace(img.Caption)
+	img.AltText = strings.TrimSpace(img.AltText)
+	if len(img.Title) > MaxImageTitle || len(img.AltText) > MaxImageAltText ||
+		len(img.Caption) > MaxImageCaption {
+		return ErrImageTextTooLong
+	}
+	return is.db.Model(&Image{}).Where("id = ?", img.ID).Updates(map[string]interface{}{
+		"title":    img.Title,
+		"caption":  img.Caption,
+		"alt_text": img.AltText,
+	}).Error
+}
+
+func (is *imageService) ByGalleryID(galleryID uint) ([]Image, error) {
+	return is.byGalleryID(galleryID, SortCustom)
+}
+
+func (is *imageService) ByGallery(gallery *Gallery) ([]Image, error) {
+	return is.byGalleryID(gallery.ID, gallery.SortMode)
+}
+
+func (is *imageService) PageByGallery(gallery *Gallery, offset, limit int) ([]Image, int, error) {
+	var total int
+	db := is.db.Model(&Image{}).Where("gallery_id = ?", gallery.ID)
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var images []Image
+	err := db.Order(imageOrder(gallery.SortMode)).
+		Offset(offset).Limit(limit).Find(&images).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := is.loadTags(images); err != nil {
+		return nil, 0, err
+	}
+	return images, total, nil
+}
+
+func (is *imageService) PageByTag(tag string, viewerID uint, offset, limit int) ([]Image, int, error) {
+	var total int
+	db := is.db.Model(&Image{}).
+		Joins("JOIN galleries ON galleries.id = images.gallery_id AND galleries.deleted_at IS NULL").
+		Joins("JOIN image_tags ON image_tags.image_id = images.id").
+		Joins("JOIN tags ON tags.id = image_tags.tag_id").
+		Where("tags.name = ?", NormalizeTag(tag)).
+		Where(visibleGallery, false, viewerID, viewerID)
+	if err := db.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var images []Image
+	err := db.Select("images.*").Order("images.created_at DESC, images.id DESC").
+		Offset(offset).Limit(limit).Find(&images).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := is.loadTags(images); err != nil {
+		return nil, 0, err
+	}
+	return images, total, nil
+}
+
+func (is *imageService) SetTags(img *Image) error {
+	tags, err := normalizeTags(img.Tags)
+	if err != nil {
+		return err
+	}
+	img.Tags = tags
+	return setTags(is.db, "image_tags", "image_id", img.ID, img.Tags)
+}
+
+// loadTags fills in the tags of each image
+func (is *imageService) loadTags(images []Image) error {
+	ids := make([]uint, len(images))
+	for i := range images {
+		ids[i] = images[i].ID
+	}
+	tags, err := tagNames(is.db, "image_tags", "image_id", ids)
+	if err != nil {
+		return err
+	}
+	for i := range images {
+		images[i].Tags = tags[images[i].ID]
+	}
+	return nil
+}
+
+func (is *imageService) byGalleryID(galleryID uint, sortMode string) ([]Image, error) {
+	var images []Image
+	err := is.db.Where("gallery_id = ?", galleryID).
+		Order(imageOrder(sortMode)).Find(&images).Error
+	if err != nil {
+		return nil, err
 	}
 	return images, nil
 }
+
+// imageOrder returns the ORDER BY clause for a gallery sort mode, ties
+// are broken by id so the order is always stable
+func imageOrder(sortMode string) string {
+	switch sortMode {
+	case SortTaken:
+		return "taken_at IS NULL, taken_at, position, id"
+	case SortUploaded:
+		return "created_at, id"
+	case SortFilename:
+		return "LOWER(filename), id"
+	default:
+		return "position, id"
+	}
+}
+
+func (is *imageService) Reorder(galleryID uint, filenames []string) error {
+	images, err := is.ByGalleryID(galleryID)
+	if err != nil {
+		return err
+	}
+	// positions are renumbered first so images that were never ordered,
+	// which all share position 0, each get a slot of their own
+	order := make([]int, len(images))
+	index := make(map[string]int, len(images))
+	for i, img := range images {
+		order[i] = i + 1
+		index[img.Filename] = i
+	}
+	// the listed images swap the slots they already held between each
+	// other, which lets a single page of a large gallery be reordered
+	var listed []int
+	seen := make(map[string]bool, len(filenames))
+	for _, name := range filenames {
+		if i, ok := index[name]; ok && !seen[name] {
+			seen[name] = true
+			listed = append(listed, i)
+		}
+	}
+	slots := make([]int, len(listed))
+	for j, i := range listed {
+		slots[j] = order[i]
+	}
+	sort.Ints(slots)
+	for j, i := range listed {
+		order[i] = slots[j]
+	}
+	tx := is.db.Begin()
+	for i, img := range images {
+		if order[i] == img.Position {
+			continue
+		}
+		err := tx.Model(&Image{}).Where("id = ?", img.ID).
+			UpdateColumn("position", order[i]).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func (is *imageService) Summarize(galleries []Gallery) error {
+	if len(galleries) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(galleries))
+	var coverIDs []uint
+	byID := make(map[uint]*Gallery, len(galleries))
+	for i := range galleries {
+		g := &galleries[i]
+		ids[i] = g.ID
+		byID[g.ID] = g
+		g.LastUpdated = g.UpdatedAt
+		if g.CoverImageID > 0 {
+			coverIDs = append(coverIDs, g.CoverImageID)
+		}
+	}
+	rows, err := is.db.Model(&Image{}).Where("gallery_id IN (?)", ids).
+		Select("gallery_id, COUNT(*), MAX(updated_at)").Group("gallery_id").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var galleryID uint
+		var count int
+		var updated time.Time
+		if err := rows.Scan(&galleryID, &count, &updated); err != nil {
+			return err
+		}
+		g := byID[galleryID]
+		g.ImageCount = count
+		if updated.After(g.LastUpdated) {
+			g.LastUpdated = updated
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	var covers []Image
+	if len(coverIDs) > 0 {
+		err := is.db.Where("id IN (?) AND gallery_id IN (?)", coverIDs, ids).Find(&covers).Error
+		if err != nil {
+			return err
+		}
+	}
+	coverByID := make(map[uint]Image, len(covers))
+	for _, img := range covers {
+		coverByID[img.ID] = img
+	}
+	// galleries without a chosen cover, or whose cover was deleted, use
+	// their first image in the custom order
+	var firsts []Image
+	err = is.db.Where("(gallery_id, position) IN ?", is.db.Model(&Image{}).
+		Select("gallery_id, MIN(position)").Where("gallery_id IN (?)", ids).
+		Group("gallery_id").SubQuery()).Order("id").Find(&firsts).Error
+	if err != nil {
+		return err
+	}
+	firstByGallery := make(map[uint]Image, len(firsts))
+	for _, img := range firsts {
+		if _, ok := firstByGallery[img.GalleryID]; !ok {
+			firstByGallery[img.GalleryID] = img
+		}
+	}
+	for i := range galleries {
+		g := &galleries[i]
+		if img, ok := coverByID[g.CoverImageID]; ok && img.GalleryID == g.ID {
+			g.Cover = &img
+		} else if img, ok := firstByGallery[g.ID]; ok {
+			g.Cover = &img
+		}
+	}
+	return nil
+}
+
+func (is *imageService) Rerender(ctx context.Context, galleryID uint) error {
+	images, err := is.ByGalleryID(galleryID)
+	if err != nil {
+		return err
+	}
+	for i := range images {
+		img := &images[i]
+		if _, err := os.Stat(img.originalPath()); os.IsNotExist(err) {
+			continue
+		}
+		if err := is.render(ctx, img); err != nil {
+			return err
+		}
+		if err := is.db.Save(img).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (is *imageService) Open(img *Image, rendition string) (io.ReadCloser, error) {
+	switch rendition {
+	case RenditionOriginal:
+		// images uploaded before originals were kept only have one copy
+		f, err := os.Open(img.originalPath())
+		if os.IsNotExist(err) {
+			return os.Open(img.RootPath())
+		}
+		return f, err
+	case RenditionWeb:
+		return os.Open(img.RootPath())
+	default:
+		return nil, ErrRenditionInvalid
+	}
+}
+
 func (is *imageService) Delete(img *Image) error {
-	return os.Remove(img.RootPath())
+	if img.ID == 0 {
+		if existing, err := is.ByFilename(img.GalleryID, img.Filename); err == nil {
+			img.ID = existing.ID
+		}
+	}
+	for _, path := range []string{img.RootPath(), img.originalPath()} {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	err := is.db.Exec(`DELETE FROM image_tags WHERE image_id IN
+		(SELECT id FROM images WHERE gallery_id = ? AND filename = ?)`,
+		img.GalleryID, img.Filename).Error
+	if err != nil {
+		return err
+	}
+	err = is.db.Unscoped().
+		Where("gallery_id = ? AND filename = ?", img.GalleryID, img.Filename).
+		Delete(&Image{}).Error
+	if err != nil {
+		return err
+	}
+	RecordEvent(is.audit, is.actor, AuditImageDelete, TargetImage, img.ID,
+		map[string]interface{}{"gallery_id": img.GalleryID, "filename": img.Filename})
+	return nil
 }
 
 func (is *imageService) imagePath(galleryID uint) string {
-	return fmt.Sprintf("images/galleries/%v/", galleryID)
+	return fmt.Sprintf("%s%v/", imageRootDir, galleryID)
 }
 
 func (is *imageService) mkImagePath(galleryID uint) (string, error) {
@@ -86,3 +702,219 @@ func (is *imageService) mkImagePath(galleryID uint) (string, error) {
 	}
 	return galleryPath, nil
 }
+
+// writeFileAtomic copies r into a temp file in the same directory as path,
+// fsyncs it and renames it to path only once everything has been written.
+// The temp file is removed if anything fails or ctx is cancelled so that a
+// truncated image can never show up in a gallery.  The number of bytes
+// written and their hex encoded sha256 checksum are returned.
+func writeFileAtomic(ctx context.Context, path string, r io.Reader) (int64, string, error) {
+	dir, name := filepath.Split(path)
+	tmp, err := os.CreateTemp(dir, tmpImagePrefix+name+"-*")
+	if err != nil {
+		return 0, "", err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), &ctxReader{ctx: ctx, r: r})
+	if err != nil {
+		return 0, "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		return 0, "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, "", err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return 0, "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, "", err
+	}
+	committed = true
+	syncDir(dir)
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// linkFileAtomic makes dst a hard link to src, falling back to copying it
+// when the two are on file systems that cannot link between each other
+func linkFileAtomic(ctx context.Context, src, dst string) error {
+	dir, name := filepath.Split(dst)
+	tmp, err := os.CreateTemp(dir, tmpImagePrefix+name+"-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	os.Remove(tmp.Name())
+	if err := os.Link(src, tmp.Name()); err == nil {
+		if err := os.Rename(tmp.Name(), dst); err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+		syncDir(dir)
+		return nil
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, _, err = writeFileAtomic(ctx, dst, f)
+	return err
+}
+
+// stagingPath reserves a temp name next to path for a file that is moved
+// to path later.  The name starts with tmpImagePrefix so it is never served
+// and garbage collection removes it if the move never happens.
+func stagingPath(path string) (string, error) {
+	dir, name := filepath.Split(path)
+	f, err := os.CreateTemp(dir, tmpImagePrefix+name+"-*")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	return f.Name(), nil
+}
+
+// syncDir flushes a directory so a rename within it survives a crash.
+// Not every platform supports syncing directories so errors are ignored.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// permittedTypes maps the extensions images may be uploaded with to the
+// content type their contents have to be detected as
+var permittedTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+}
+
+// checkImageType returns ErrImageType unless both the extension of
+// filename and the first bytes of the image are for a permitted type
+func checkImageType(filename string, br *bufio.Reader) error {
+	want, ok := permittedTypes[strings.ToLower(filepath.Ext(filename))]
+	if !ok {
+		return ErrImageType
+	}
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if http.DetectContentType(head) != want {
+		return ErrImageType
+	}
+	return nil
+}
+
+// maxReader returns ErrUploadSize instead of silently truncating once
+// more than n bytes have been read
+type maxReader struct {
+	r io.Reader
+	n int64
+}
+
+func (mr *maxReader) Read(p []byte) (int, error) {
+	if mr.n < 0 {
+		return 0, ErrUploadSize
+	}
+	if int64(len(p)) > mr.n+1 {
+		p = p[:mr.n+1]
+	}
+	n, err := mr.r.Read(p)
+	mr.n -= int64(n)
+	if mr.n < 0 {
+		return n, ErrUploadSize
+	}
+	return n, err
+}
+
+// ctxReader stops a copy as soon as its context is cancelled
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// backfillImages creates db records for images that were written to the
+// file system before image metadata was kept in the db.  Leftover temp
+// files from interrupted uploads are removed along the way.
+func backfillImages(db *gorm.DB) error {
+	dirs, err := filepath.Glob(imageRootDir + "*")
+	if err != nil {
+		return err
+	}
+	is := &imageService{db: db, metrics: noMetrics{}}
+	for _, dir := range dirs {
+		id, err := strconv.ParseUint(filepath.Base(dir), 10, 64)
+		if err != nil {
+			continue
+		}
+		existing, err := is.ByGalleryID(uint(id))
+		if err != nil {
+			return err
+		}
+		known := make(map[string]bool, len(existing))
+		for _, img := range existing {
+			known[img.Filename] = true
+		}
+		paths, err := filepath.Glob(filepath.Join(dir, "*"))
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			name := filepath.Base(path)
+			if strings.HasPrefix(name, tmpImagePrefix) {
+				os.Remove(path)
+				continue
+			}
+			if known[name] {
+				continue
+			}
+			img := Image{GalleryID: uint(id), Filename: name}
+			if img.Size, img.Checksum, err = checksumFile(path); err != nil {
+				return err
+			}
+			if err := db.Create(&img).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checksumFile returns the size and hex encoded sha256 checksum of a file
+func checksumFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
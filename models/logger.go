@@ -0,0 +1,37 @@
+package models
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// gormLogger sends what gorm logs to a structured logger instead of
+// stdout.  Queries are logged at debug without their values so secrets
+// like password hashes stay out of the logs.
+type gormLogger struct {
+	logger *slog.Logger
+}
+
+// Print is called by gorm with the kind of message, where it was logged
+// from and then what is logged
+func (l gormLogger) Print(values ...interface{}) {
+	if len(values) < 2 {
+		return
+	}
+	kind, _ := values[0].(string)
+	source := fmt.Sprint(values[1])
+	switch {
+	case kind == "sql" && len(values) >= 6:
+		took, _ := values[2].(time.Duration)
+		l.logger.Debug("query", "sql", values[3], "rows", values[5], "duration", took, "source", source)
+	case kind == "error" || kind == "log":
+		l.logger.Error("database", "error", fmt.Sprint(values[2:]...), "source", source)
+	case kind == "warning":
+		l.logger.Warn(source)
+	default:
+		// callbacks being registered and other notices, values[1] is the
+		// message for these
+		l.logger.Debug(source)
+	}
+}
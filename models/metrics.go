@@ -0,0 +1,66 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Metrics is told what the services are doing so the site can be
+// monitored, see WithMetrics
+type Metrics interface {
+	// QueryDone is called after every db query with the kind of query and
+	// the table it ran on
+	QueryDone(operation, table string, took time.Duration)
+	// ImageUploaded and ImageUploadFailed are called for every image that
+	// is uploaded, unzipped or finished by a resumable upload
+	ImageUploaded(bytes int64)
+	ImageUploadFailed()
+	LoginFailed()
+}
+
+// noMetrics is used by services that were set up without WithMetrics
+type noMetrics struct{}
+
+func (noMetrics) QueryDone(operation, table string, took time.Duration) {}
+func (noMetrics) ImageUploaded(bytes int64)                             {}
+func (noMetrics) ImageUploadFailed()                                    {}
+func (noMetrics) LoginFailed()                                          {}
+
+// orNoMetrics returns m or, when it is nil, metrics that are discarded
+func orNoMetrics(m Metrics) Metrics {
+	if m == nil {
+		return noMetrics{}
+	}
+	return m
+}
+
+// queryStartKey is where the time a query started is kept on its scope
+const queryStartKey = "metrics:query_start"
+
+// instrumentQueries times every query db runs and tells m about it
+func instrumentQueries(db *gorm.DB, m Metrics) {
+	start := func(scope *gorm.Scope) {
+		scope.InstanceSet(queryStartKey, time.Now())
+	}
+	done := func(operation string) func(*gorm.Scope) {
+		return func(scope *gorm.Scope) {
+			started, ok := scope.InstanceGet(queryStartKey)
+			if !ok {
+				return
+			}
+			m.QueryDone(operation, scope.TableName(), time.Since(started.(time.Time)))
+		}
+	}
+	cb := db.Callback()
+	cb.Create().Before("gorm:begin_transaction").Register("metrics:start", start)
+	cb.Create().After("gorm:commit_or_rollback_transaction").Register("metrics:done", done("create"))
+	cb.Query().Before("gorm:query").Register("metrics:start", start)
+	cb.Query().After("gorm:after_query").Register("metrics:done", done("query"))
+	cb.Update().Before("gorm:begin_transaction").Register("metrics:start", start)
+	cb.Update().After("gorm:commit_or_rollback_transaction").Register("metrics:done", done("update"))
+	cb.Delete().Before("gorm:begin_transaction").Register("metrics:start", start)
+	cb.Delete().After("gorm:commit_or_rollback_transaction").Register("metrics:done", done("delete"))
+	cb.RowQuery().Before("gorm:row_query").Register("metrics:start", start)
+	cb.RowQuery().After("gorm:row_query").Register("metrics:done", done("row_query"))
+}
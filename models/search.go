@@ -0,0 +1,141 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// MaxSearchResults is the most galleries and the most images returned by
+// a single search
+const MaxSearchResults = 50
+
+// SearchResults are the galleries and images that matched a search
+type SearchResults struct {
+	Query     string
+	Galleries []Gallery
+	Images    []Image
+}
+
+// SearchService finds galleries by their title or tags and images by
+// their title, caption, filename or tags
+type SearchService interface {
+	// Search returns what matches query that the user with viewerID can
+	// see, pass 0 for visitors who are not logged in
+	Search(query string, viewerID uint) (*SearchResults, error)
+}
+
+// NewSearchService uses postgres full-text search when the db is postgres
+// and falls back to simple substring matching for other dialects
+func NewSearchService(db *gorm.DB) SearchService {
+	if db.Dialect().GetName() == "postgres" {
+		return &searchService{&postgresSearch{db}}
+	}
+	return &searchService{&likeSearch{db}}
+}
+
+type searchService struct {
+	SearchService
+}
+
+func (ss *searchService) Search(query string, viewerID uint) (*SearchResults, error) {
+	query = strings.Join(strings.Fields(query), " ")
+	if query == "" {
+		return &SearchResults{}, nil
+	}
+	return ss.SearchService.Search(query, viewerID)
+}
+
+const (
+	// galleryDocument and imageDocument are the text that is searched for
+	// galleries and images.  They must match the expressions the search
+	// indexes are created on or postgres will not use the indexes.
+	galleryDocument = "to_tsvector('english', galleries.title)"
+	imageDocument   = "to_tsvector('english', coalesce(images.title, '') || ' ' || " +
+		"coalesce(images.caption, '') || ' ' || images.filename)"
+)
+
+// createSearchIndexes adds the indexes full-text search relies on
+func createSearchIndexes(db *gorm.DB) error {
+	if db.Dialect().GetName() != "postgres" {
+		return nil
+	}
+	for _, stmt := range []string{
+		"CREATE INDEX IF NOT EXISTS idx_galleries_search ON galleries USING gin ((" + strings.ReplaceAll(galleryDocument, "galleries.", "") + "))",
+		"CREATE INDEX IF NOT EXISTS idx_images_search ON images USING gin ((" + strings.ReplaceAll(imageDocument, "images.", "") + "))",
+	} {
+		if err := db.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type postgresSearch struct {
+	db *gorm.DB
+}
+
+func (ps *postgresSearch) Search(query string, viewerID uint) (*SearchResults, error) {
+	results := SearchResults{Query: query}
+	tsquery := "plainto_tsquery('english', ?)"
+	err := ps.db.Select("galleries.*").
+		Where(visibleGallery, false, viewerID, viewerID).
+		Where(galleryDocument+" @@ "+tsquery+` OR EXISTS (SELECT 1 FROM gallery_tags
+			JOIN tags ON tags.id = gallery_tags.tag_id
+			WHERE gallery_tags.gallery_id = galleries.id
+			AND to_tsvector('english', tags.name) @@ `+tsquery+")", query, query).
+		Order(gorm.Expr("ts_rank("+galleryDocument+", "+tsquery+") DESC, galleries.id", query)).
+		Limit(MaxSearchResults).Find(&results.Galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	err = ps.db.Select("images.*").
+		Joins("JOIN galleries ON galleries.id = images.gallery_id AND galleries.deleted_at IS NULL").
+		Where(visibleGallery, false, viewerID, viewerID).
+		Where(imageDocument+" @@ "+tsquery+` OR images.filename ILIKE ? OR EXISTS (SELECT 1 FROM image_tags
+			JOIN tags ON tags.id = image_tags.tag_id
+			WHERE image_tags.image_id = images.id
+			AND to_tsvector('english', tags.name) @@ `+tsquery+")", query, "%"+likeEscape(query)+"%", query).
+		Order(gorm.Expr("ts_rank("+imageDocument+", "+tsquery+") DESC, images.id", query)).
+		Limit(MaxSearchResults).Find(&results.Images).Error
+	if err != nil {
+		return nil, err
+	}
+	return &results, nil
+}
+
+// likeSearch matches anything that contains the query, ignoring case
+type likeSearch struct {
+	db *gorm.DB
+}
+
+func (ls *likeSearch) Search(query string, viewerID uint) (*SearchResults, error) {
+	results := SearchResults{Query: query}
+	// wildcards are not escaped as dialects disagree on how to, at worst
+	// they match a little more than was asked for
+	pattern := "%" + strings.ToLower(query) + "%"
+	err := ls.db.Select("galleries.*").
+		Where(visibleGallery, false, viewerID, viewerID).
+		Where(`LOWER(galleries.title) LIKE ? OR EXISTS (SELECT 1 FROM gallery_tags
+			JOIN tags ON tags.id = gallery_tags.tag_id
+			WHERE gallery_tags.gallery_id = galleries.id AND tags.name LIKE ?)`, pattern, pattern).
+		Order("galleries.title, galleries.id").
+		Limit(MaxSearchResults).Find(&results.Galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	err = ls.db.Select("images.*").
+		Joins("JOIN galleries ON galleries.id = images.gallery_id AND galleries.deleted_at IS NULL").
+		Where(visibleGallery, false, viewerID, viewerID).
+		Where(`LOWER(images.title) LIKE ? OR LOWER(images.caption) LIKE ?
+			OR LOWER(images.filename) LIKE ? OR EXISTS (SELECT 1 FROM image_tags
+			JOIN tags ON tags.id = image_tags.tag_id
+			WHERE image_tags.image_id = images.id AND tags.name LIKE ?)`,
+			pattern, pattern, pattern, pattern).
+		Order("images.filename, images.id").
+		Limit(MaxSearchResults).Find(&results.Images).Error
+	if err != nil {
+		return nil, err
+	}
+	return &results, nil
+}
@@ -1,6 +1,10 @@
 package models
 
 import (
+	"context"
+	"log/slog"
+	"os"
+
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres" //initializes postgres drivers
 	"github.com/pkg/errors"
@@ -31,7 +35,7 @@ func WithUser(pepper, hmacKey string) ServicesConfig {
 		if s.db == nil {
 			return ErrNoDBConnection
 		}
-		s.User = NewUserService(s.db, pepper, hmacKey)
+		s.User = NewUserService(s.db, pepper, hmacKey, s.metrics)
 		return nil
 	}
 }
@@ -48,14 +52,119 @@ func WithGallery() ServicesConfig {
 	}
 }
 
+// WithCollection defines a configuration function for services pertaining
+// to CRUD interactions with collections in a gorm database. *Requires gorm service
+func WithCollection() ServicesConfig {
+	return func(s *Services) error {
+		if s.db == nil {
+			return ErrNoDBConnection
+		}
+		s.Collection = NewCollectionService(s.db)
+		return nil
+	}
+}
+
+// WithCollaborator defines a configuration function for services pertaining
+// to sharing galleries with other users in a gorm database. *Requires gorm service
+func WithCollaborator(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		if s.db == nil {
+			return ErrNoDBConnection
+		}
+		s.Collaborator = NewCollaboratorService(s.db, hmacKey)
+		return nil
+	}
+}
+
+// WithAdmin defines a configuration function for services pertaining to
+// the admin dashboard. *Requires gorm service
+func WithAdmin() ServicesConfig {
+	return func(s *Services) error {
+		if s.db == nil {
+			return ErrNoDBConnection
+		}
+		s.Admin = NewAdminService(s.db)
+		return nil
+	}
+}
+
+// WithAudit defines a configuration function for services pertaining to
+// reading the audit log in a gorm database. *Requires gorm service
+func WithAudit() ServicesConfig {
+	return func(s *Services) error {
+		if s.db == nil {
+			return ErrNoDBConnection
+		}
+		s.Audit = NewAuditService(s.db)
+		return nil
+	}
+}
+
+// WithSearch defines a configuration function for services pertaining to
+// searching galleries and images in a gorm database. *Requires gorm service
+func WithSearch() ServicesConfig {
+	return func(s *Services) error {
+		if s.db == nil {
+			return ErrNoDBConnection
+		}
+		s.Search = NewSearchService(s.db)
+		return nil
+	}
+}
+
 // WithImage defines a configuration function for services pertaining to
-// CRUD operations on images in the local filesystem.
+// CRUD operations on images in the local filesystem and their metadata
+// in a gorm database. *Requires gorm service
 func WithImage() ServicesConfig {
 	return func(s *Services) error {
 		if s.db == nil {
 			return ErrNoDBConnection
 		}
-		s.Image = NewImageService()
+		s.Image = NewImageService(s.db, s.metrics)
+		return nil
+	}
+}
+
+// WithUpload defines a configuration function for services pertaining to
+// resumable image uploads. *Requires gorm and image services
+func WithUpload() ServicesConfig {
+	return func(s *Services) error {
+		if s.db == nil {
+			return ErrNoDBConnection
+		}
+		if s.Image == nil {
+			return ErrNoImageService
+		}
+		s.Upload = NewUploadService(s.db, s.Image)
+		return nil
+	}
+}
+
+// WithMetrics defines a configuration function for instrumenting the
+// services so the site can be monitored.  Every db query is timed, and
+// login failures and image uploads are counted by the services configured
+// after it. *Requires gorm service
+func WithMetrics(m Metrics) ServicesConfig {
+	return func(s *Services) error {
+		if s.db == nil {
+			return ErrNoDBConnection
+		}
+		s.metrics = m
+		instrumentQueries(s.db, m)
+		return nil
+	}
+}
+
+// WithLogger defines a configuration function for sending what the gorm
+// database logs to logger, queries are only logged when LogMode is on.
+// It should come before the other configs so they log to it too.
+// *Requires gorm service
+func WithLogger(logger *slog.Logger) ServicesConfig {
+	return func(s *Services) error {
+		if s.db == nil {
+			return ErrNoDBConnection
+		}
+		s.db.SetLogger(gormLogger{logger})
 		return nil
 	}
 }
@@ -86,10 +195,17 @@ func NewServices(cfgs ...ServicesConfig) (*Services, error) {
 
 // Services contains the type of services this app provides.
 type Services struct {
-	Gallery GalleryService
-	User    UserService
-	Image   ImageService
-	db      *gorm.DB
+	Gallery      GalleryService
+	Collection   CollectionService
+	User         UserService
+	Image        ImageService
+	Upload       UploadService
+	Search       SearchService
+	Collaborator CollaboratorService
+	Admin        AdminService
+	Audit        AuditService
+	db           *gorm.DB
+	metrics      Metrics
 }
 
 // Close closes the database connections.
@@ -97,9 +213,26 @@ func (s *Services) Close() error {
 	return s.db.Close()
 }
 
-//DestructiveReset drops all tables and rebuilds them.
+// Ping checks that the database can be reached
+func (s *Services) Ping(ctx context.Context) error {
+	return s.db.DB().PingContext(ctx)
+}
+
+// CheckStorage checks that images can be written to the directories they
+// are stored in
+func (s *Services) CheckStorage() error {
+	for _, dir := range []string{imageRootDir, originalRootDir} {
+		if err := checkWritable(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DestructiveReset drops all tables and rebuilds them.
 func (s *Services) DestructiveReset() error {
-	err := s.db.DropTableIfExists(&User{}, &Gallery{}).Error
+	err := s.db.DropTableIfExists(&User{}, &Gallery{}, &Collection{}, &Image{}, &Upload{},
+		&Tag{}, &GalleryTag{}, &ImageTag{}, &Collaborator{}, &AuditEvent{}).Error
 	if err != nil {
 		return err
 	}
@@ -107,6 +240,32 @@ func (s *Services) DestructiveReset() error {
 }
 
 // AutoMigrate will appempt to automatically migrate all tables.
+// Images already on disk without a db record are backfilled, as is the
+// gallery of audit events recorded before events kept it.
 func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&User{}, &Gallery{}).Error
+	if err := s.db.AutoMigrate(&User{}, &Gallery{}, &Collection{}, &Image{}, &Upload{},
+		&Tag{}, &GalleryTag{}, &ImageTag{}, &Collaborator{}, &AuditEvent{}).Error; err != nil {
+		return err
+	}
+	if err := createSearchIndexes(s.db); err != nil {
+		return err
+	}
+	if err := backfillAuditGalleries(s.db); err != nil {
+		return err
+	}
+	return backfillImages(s.db)
+}
+
+// checkWritable creates dir if it does not exist yet and writes a file to
+// it, the file is removed again
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".check-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
 }
@@ -0,0 +1,139 @@
+package models
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// MaxTagLength is the longest a single tag can be in characters
+	MaxTagLength = 50
+	// MaxTags is the most tags a gallery or image can have
+	MaxTags = 30
+)
+
+// Tag is a label that galleries and images can be browsed by.  Tags are
+// shared by everyone so the same name is only ever stored once.
+type Tag struct {
+	ID   uint   `gorm:"primary_key"`
+	Name string `gorm:"not null;unique_index"`
+}
+
+// GalleryTag joins a tag to a gallery
+type GalleryTag struct {
+	GalleryID uint `gorm:"primary_key;auto_increment:false"`
+	TagID     uint `gorm:"primary_key;auto_increment:false;index"`
+}
+
+// ImageTag joins a tag to an image
+type ImageTag struct {
+	ImageID uint `gorm:"primary_key;auto_increment:false"`
+	TagID   uint `gorm:"primary_key;auto_increment:false;index"`
+}
+
+// ParseTags splits a comma separated list of tags as typed into a form
+func ParseTags(s string) []string {
+	var tags []string
+	for _, tag := range strings.Split(s, ",") {
+		if tag = NormalizeTag(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// NormalizeTag returns the form a tag is stored in, lower case with
+// surrounding space trimmed and any other runs of space collapsed
+func NormalizeTag(tag string) string {
+	return strings.ToLower(strings.Join(strings.Fields(tag), " "))
+}
+
+// normalizeTags normalizes every tag in the list dropping duplicates and
+// makes sure there are not too many and each only has letters, numbers,
+// spaces and dashes
+func normalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool, len(tags))
+	result := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = NormalizeTag(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len([]rune(tag)) > MaxTagLength {
+			return nil, ErrTagInvalid
+		}
+		for _, c := range tag {
+			if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != ' ' && c != '-' {
+				return nil, ErrTagInvalid
+			}
+		}
+		seen[tag] = true
+		result = append(result, tag)
+	}
+	if len(result) > MaxTags {
+		return nil, ErrTooManyTags
+	}
+	return result, nil
+}
+
+// setTags replaces the tags joined to owner in the join table with the
+// tags named, creating any of them that do not exist yet
+func setTags(db *gorm.DB, table, column string, owner uint, names []string) error {
+	tx := db.Begin()
+	err := tx.Exec("DELETE FROM "+table+" WHERE "+column+" = ?", owner).Error
+	for _, name := range names {
+		if err != nil {
+			break
+		}
+		var tag Tag
+		err = tx.Where(Tag{Name: name}).FirstOrCreate(&tag).Error
+		if err == nil {
+			err = tx.Exec("INSERT INTO "+table+" ("+column+", tag_id) VALUES (?, ?)", owner, tag.ID).Error
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// tagNames returns the names of the tags joined to each of the owners in
+// the join table, keyed by owner
+func tagNames(db *gorm.DB, table, column string, owners []uint) (map[uint][]string, error) {
+	tags := make(map[uint][]string)
+	if len(owners) == 0 {
+		return tags, nil
+	}
+	rows, err := db.Table(table).
+		Select(table+"."+column+", tags.name").
+		Joins("JOIN tags ON tags.id = "+table+".tag_id").
+		Where(table+"."+column+" IN (?)", owners).
+		Order("tags.name").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var owner uint
+		var name string
+		if err := rows.Scan(&owner, &name); err != nil {
+			return nil, err
+		}
+		tags[owner] = append(tags[owner], name)
+	}
+	return tags, rows.Err()
+}
+
+// likePrefix returns a LIKE pattern matching everything that starts with s
+func likePrefix(s string) string {
+	return likeEscape(s) + "%"
+}
+
+// likeEscape escapes the wildcards in s so they are matched literally by
+// LIKE in postgres, where backslash is the default escape character
+func likeEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
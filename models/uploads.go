@@ -0,0 +1,280 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// MaxUploadSize is the largest image in bytes that can be uploaded
+	MaxUploadSize = 100 << 20 // 100 megabytes
+	// uploadDir holds the part files of uploads that are still in progress.
+	// It must not be under images/ as that directory is publicly served
+	uploadDir = "uploads/"
+)
+
+// Upload tracks a resumable image upload.  Chunks are appended to a part
+// file until Size bytes have been received at which point the part file
+// is turned into an Image of the upload's gallery.
+type Upload struct {
+	gorm.Model
+	GalleryID uint   `gorm:"not null;index"`
+	UserID    uint   `gorm:"not null"`
+	Filename  string `gorm:"not null"`
+	Size      int64  `gorm:"not null"`
+	Offset    int64  `gorm:"not null"`
+}
+
+// Complete reports if every byte of the upload has been received
+func (u *Upload) Complete() bool {
+	return u.Offset >= u.Size
+}
+
+// partPath is where the bytes received so far are stored
+func (u *Upload) partPath() string {
+	return fmt.Sprintf("%s%d.part", uploadDir, u.ID)
+}
+
+// UploadService is used to work with resumable uploads
+type UploadService interface {
+	// WriteChunk appends the bytes read from r to the upload.  offset must
+	// match the number of bytes already received or ErrUploadOffset is
+	// returned, as it is while another chunk of the upload is still being
+	// written.  Whatever was received before an error or cancellation
+	// of ctx is kept so the client can resume from the upload's Offset.
+	// Once the upload is complete the image is created and returned and
+	// the upload is deleted.
+	WriteChunk(ctx context.Context, upload *Upload, offset int64, r io.Reader) (*Image, error)
+	// As returns the service acting for actor, the images their uploads
+	// create are recorded in the audit log
+	As(actor Actor) UploadService
+	UploadDB
+}
+
+// UploadDB is used to interact with the uploads database
+type UploadDB interface {
+	ByID(id uint) (*Upload, error)
+	Create(upload *Upload) error
+	Update(upload *Upload) error
+	Delete(id uint) error
+}
+
+// NewUploadService creates an UploadService that hands finished uploads
+// to the given ImageService
+func NewUploadService(db *gorm.DB, is ImageService) UploadService {
+	return &uploadService{
+		UploadDB: &uploadValidator{&uploadGorm{db}},
+		is:       is,
+		writing:  &sync.Map{},
+	}
+}
+
+var _ UploadService = &uploadService{}
+
+type uploadService struct {
+	UploadDB
+	is ImageService
+	// writing holds the IDs of the uploads a chunk is being written to,
+	// it is shared by the copies As makes
+	writing *sync.Map
+}
+
+func (us *uploadService) As(actor Actor) UploadService {
+	bound := *us
+	bound.is = us.is.As(actor)
+	return &bound
+}
+
+func (us *uploadService) WriteChunk(ctx context.Context, upload *Upload, offset int64, r io.Reader) (*Image, error) {
+	// two chunks written at once would both start at the same offset and
+	// overwrite each other, whichever comes second has to resume instead
+	if _, busy := us.writing.LoadOrStore(upload.ID, struct{}{}); busy {
+		return nil, ErrUploadOffset
+	}
+	defer us.writing.Delete(upload.ID)
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(upload.partPath(), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// the part file is the source of truth as the process may have been
+	// stopped after a chunk was written but before Offset was saved
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	upload.Offset = info.Size()
+	if upload.Offset > upload.Size {
+		upload.Offset = upload.Size
+	}
+	if offset != upload.Offset {
+		return nil, ErrUploadOffset
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	remaining := upload.Size - upload.Offset
+	n, copyErr := io.Copy(f, io.LimitReader(&ctxReader{ctx: ctx, r: r}, remaining))
+	upload.Offset += n
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	if err := us.Update(upload); err != nil {
+		return nil, err
+	}
+	if copyErr != nil {
+		return nil, copyErr
+	}
+	if !upload.Complete() {
+		return nil, nil
+	}
+	return us.finish(ctx, upload)
+}
+
+// finish turns a completed upload into an image and removes the upload
+func (us *uploadService) finish(ctx context.Context, upload *Upload) (*Image, error) {
+	part, err := os.Open(upload.partPath())
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{
+		GalleryID: upload.GalleryID,
+		Filename:  upload.Filename,
+	}
+	if err := us.is.Create(ctx, img, part); err != nil {
+		if err == ErrImageType || err == ErrUploadSize {
+			// resuming can never fix the contents of the upload
+			us.Delete(upload.ID)
+		}
+		return nil, err
+	}
+	if err := us.Delete(upload.ID); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+type uploadValidator struct {
+	UploadDB
+}
+
+func (uv *uploadValidator) Create(upload *Upload) error {
+	if err := runUploadValFuncs(upload,
+		uv.galleryIDRequired,
+		uv.userIDRequired,
+		uv.normalizeFilename,
+		uv.filenameValid,
+		uv.extensionPermitted,
+		uv.sizeInRange); err != nil {
+		return err
+	}
+	return uv.UploadDB.Create(upload)
+}
+
+// Delete removes the part file along with the upload
+func (uv *uploadValidator) Delete(id uint) error {
+	var upload Upload
+	upload.ID = id
+	if err := runUploadValFuncs(&upload, uv.positiveID); err != nil {
+		return err
+	}
+	err := os.Remove(upload.partPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return uv.UploadDB.Delete(id)
+}
+
+func (uv *uploadValidator) galleryIDRequired(u *Upload) error {
+	if u.GalleryID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+func (uv *uploadValidator) userIDRequired(u *Upload) error {
+	if u.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (uv *uploadValidator) normalizeFilename(u *Upload) error {
+	u.Filename = filepath.Base(strings.TrimSpace(u.Filename))
+	return nil
+}
+
+func (uv *uploadValidator) filenameValid(u *Upload) error {
+	if u.Filename == "." || u.Filename == "/" || strings.HasPrefix(u.Filename, ".") {
+		return ErrFilenameInvalid
+	}
+	return nil
+}
+
+func (uv *uploadValidator) extensionPermitted(u *Upload) error {
+	if _, ok := permittedTypes[strings.ToLower(filepath.Ext(u.Filename))]; !ok {
+		return ErrImageType
+	}
+	return nil
+}
+
+func (uv *uploadValidator) sizeInRange(u *Upload) error {
+	if u.Size <= 0 || u.Size > MaxUploadSize {
+		return ErrUploadSize
+	}
+	return nil
+}
+
+func (uv *uploadValidator) positiveID(u *Upload) error {
+	if u.ID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+type uploadValFunc func(*Upload) error
+
+func runUploadValFuncs(upload *Upload, fns ...uploadValFunc) error {
+	for _, fn := range fns {
+		if err := fn(upload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ UploadDB = &uploadGorm{}
+
+type uploadGorm struct {
+	db *gorm.DB
+}
+
+func (ug *uploadGorm) ByID(id uint) (*Upload, error) {
+	var upload Upload
+	db := ug.db.Where("id = ?", id)
+	err := first(db, &upload)
+	return &upload, err
+}
+
+func (ug *uploadGorm) Create(upload *Upload) error {
+	return ug.db.Create(upload).Error
+}
+
+func (ug *uploadGorm) Update(upload *Upload) error {
+	return ug.db.Save(upload).Error
+}
+
+func (ug *uploadGorm) Delete(id uint) error {
+	upload := Upload{Model: gorm.Model{ID: id}}
+	return ug.db.Unscoped().Delete(&upload).Error
+}
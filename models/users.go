@@ -3,6 +3,7 @@ package models
 import (
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	"golang.org/x/crypto/bcrypt"
@@ -10,6 +11,9 @@ import (
 	"lenslocked.com/rand"
 )
 
+// SessionLength is how long users stay logged in after they sign in
+const SessionLength = time.Hour
+
 // User is a type that represents user model stored in our database
 // and is used for user accounts, storying email and password info
 type User struct {
@@ -20,16 +24,26 @@ type User struct {
 	PasswordHash string `gom:"not null"`
 	Remember     string `gorm:"-"`
 	RememberHash string `gorm:"not null;unique_index"`
-}
-
-// NewUserService creates a new connections to the database
-func NewUserService(db *gorm.DB, pepper, hmacKey string) UserService {
+	// Admin users can manage every account and gallery from /admin
+	Admin bool `gorm:"not null;default:false"`
+	// Disabled users cannot log in and are treated as logged out
+	Disabled bool `gorm:"not null;default:false"`
+	// PasswordResetRequired users must choose a new password before
+	// they can do anything else
+	PasswordResetRequired bool `gorm:"not null;default:false"`
+}
+
+// NewUserService creates a new connections to the database, login
+// failures are counted in m which may be nil
+func NewUserService(db *gorm.DB, pepper, hmacKey string, m Metrics) UserService {
 	ug := &userGorm{db}
 	hmac := hash.NewHMAC(hmacKey)
 	uv := newUserValidator(ug, pepper, hmac)
 	return &userService{
-		pepper: pepper,
-		UserDB: uv,
+		pepper:  pepper,
+		UserDB:  uv,
+		audit:   NewAuditService(db),
+		metrics: orNoMetrics(m),
 	}
 }
 
@@ -39,8 +53,14 @@ type UserService interface {
 	// Authenticate will verify the provided email address
 	// and password are correct. If they are correct, the users
 	// correspoding to the email will be returned. Else you will
-	// receive ErrNotFound, ErrIDInvalid, or other errors
+	// receive ErrNotFound, ErrIDInvalid, ErrAccountDisabled or other errors
 	Authenticate(email, password string) (*User, error)
+	// LogOut gives the user a new remember token so the cookies they are
+	// logged in with stop working
+	LogOut(user *User) error
+	// As returns the service acting for actor, logins, logouts, signups
+	// and password changes are recorded in the audit log as theirs
+	As(actor Actor) UserService
 	UserDB // all methods from UserDB interface
 }
 
@@ -48,6 +68,9 @@ type UserService interface {
 // and password
 func (us *userService) Authenticate(email, password string) (*User, error) {
 	foundUser, err := us.ByEmail(email)
+	if err == ErrNotFound {
+		us.loginFailed(0, map[string]interface{}{"email": email, "reason": "unknown email"})
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -56,14 +79,74 @@ func (us *userService) Authenticate(email, password string) (*User, error) {
 	err = bcrypt.CompareHashAndPassword(foundPasswordBytes, enteredPasswordBytes)
 	switch err {
 	case bcrypt.ErrMismatchedHashAndPassword:
+		us.loginFailed(foundUser.ID, map[string]interface{}{"reason": "incorrect password"})
 		return nil, ErrPasswordIncorrect
 	case nil:
+		if foundUser.Disabled {
+			us.loginFailed(foundUser.ID, map[string]interface{}{"reason": "account disabled"})
+			return nil, ErrAccountDisabled
+		}
+		actor := us.actor
+		actor.UserID = foundUser.ID
+		RecordEvent(us.audit, actor, AuditLogin, TargetUser, foundUser.ID, nil)
 		return foundUser, nil
 	default:
 		return nil, err
 	}
 }
 
+// loginFailed records a failed login to the account with userID, 0 when
+// the email is unknown, and counts it
+func (us *userService) loginFailed(userID uint, details map[string]interface{}) {
+	RecordEvent(us.audit, us.actor, AuditLoginFailed, TargetUser, userID, details)
+	us.metrics.LoginFailed()
+}
+
+// LogOut gives the user a new remember token and records that they logged out
+func (us *userService) LogOut(user *User) error {
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	user.Remember = token
+	if err := us.UserDB.Update(user); err != nil {
+		return err
+	}
+	RecordEvent(us.audit, us.actor, AuditLogout, TargetUser, user.ID, nil)
+	return nil
+}
+
+// Create records the signup of users once they have been created
+func (us *userService) Create(user *User) error {
+	if err := us.UserDB.Create(user); err != nil {
+		return err
+	}
+	actor := us.actor
+	if actor.UserID == 0 {
+		actor.UserID = user.ID
+	}
+	RecordEvent(us.audit, actor, AuditSignup, TargetUser, user.ID, nil)
+	return nil
+}
+
+// Update records when the user's password is changed
+func (us *userService) Update(user *User) error {
+	passwordChanged := user.Password != ""
+	if err := us.UserDB.Update(user); err != nil {
+		return err
+	}
+	if passwordChanged {
+		RecordEvent(us.audit, us.actor, AuditPasswordChange, TargetUser, user.ID, nil)
+	}
+	return nil
+}
+
+func (us *userService) As(actor Actor) UserService {
+	bound := *us
+	bound.actor = actor
+	return &bound
+}
+
 // UserDB is used to interact with the users database.
 // For pretty much all single user queries:
 // if there is no record to be found nil, and error not found is returned
@@ -84,6 +167,9 @@ var _ UserService = &userService{}
 type userService struct {
 	pepper string
 	UserDB
+	audit   AuditService
+	actor   Actor
+	metrics Metrics
 }
 
 var _ UserDB = &userValidator{}
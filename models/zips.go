@@ -0,0 +1,153 @@
+package models
+
+import (
+	"archive/zip"
+	"context"
+	"io"
+	"path"
+	"strings"
+)
+
+const (
+	// MaxZipEntries is the most entries an imported archive may contain
+	MaxZipEntries = 2000
+	// MaxZipTotalSize is the most bytes that will be extracted from a
+	// single imported archive
+	MaxZipTotalSize = 4 << 30 // 4 gigabytes
+	// maxZipRatio is the largest uncompressed to compressed ratio allowed
+	// for an entry. Real jpgs and pngs barely compress at all so anything
+	// above this is treated as a zip bomb.
+	maxZipRatio = 100
+)
+
+// ZipImport reports what happened to the entries of an imported archive
+type ZipImport struct {
+	Images  []Image
+	Skipped []SkippedEntry
+}
+
+// SkippedEntry is an archive entry that was not imported and why
+type SkippedEntry struct {
+	Name   string
+	Reason string
+}
+
+// ImportZip extracts every image from the zip archive in r into the
+// gallery.  Directories, hidden files and anything that is not a
+// permitted image are skipped.  Entries are stored by their base name so
+// paths in the archive can never escape the gallery's directory, and both
+// the number of entries and the bytes actually decompressed are limited.
+func (is *imageService) ImportZip(ctx context.Context, galleryID uint, r io.ReaderAt, size int64) (*ZipImport, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, ErrZipInvalid
+	}
+	if len(zr.File) > MaxZipEntries {
+		return nil, ErrZipTooLarge
+	}
+	var result ZipImport
+	seen := make(map[string]bool)
+	var budget int64 = MaxZipTotalSize
+	for _, f := range zr.File {
+		if err := ctx.Err(); err != nil {
+			return &result, err
+		}
+		name, reason := zipEntryName(f)
+		if name == "" {
+			if reason != "" {
+				result.Skipped = append(result.Skipped, SkippedEntry{f.Name, reason})
+			}
+			continue
+		}
+		if seen[name] {
+			result.Skipped = append(result.Skipped, SkippedEntry{f.Name, "duplicate filename"})
+			continue
+		}
+		if f.UncompressedSize64 > uint64(budget) {
+			return &result, ErrZipTooLarge
+		}
+		img := Image{GalleryID: galleryID, Filename: name}
+		n, err := is.extractZipEntry(ctx, &img, f)
+		budget -= n
+		switch err {
+		case nil:
+			seen[name] = true
+			result.Images = append(result.Images, img)
+		case ErrImageType, ErrUploadSize, ErrZipInvalid:
+			result.Skipped = append(result.Skipped, SkippedEntry{f.Name, err.(modelError).Public()})
+		default:
+			return &result, err
+		}
+		if budget <= 0 {
+			return &result, ErrZipTooLarge
+		}
+	}
+	return &result, nil
+}
+
+// extractZipEntry creates an image from a single archive entry and returns
+// the number of bytes that were decompressed
+func (is *imageService) extractZipEntry(ctx context.Context, img *Image, f *zip.File) (int64, error) {
+	if f.UncompressedSize64 > MaxUploadSize {
+		return 0, ErrUploadSize
+	}
+	if f.CompressedSize64 > 0 && f.UncompressedSize64/f.CompressedSize64 > maxZipRatio {
+		return 0, ErrZipInvalid
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return 0, ErrZipInvalid
+	}
+	// the sizes in the header are only hints, what is actually read is
+	// capped so a lying header cannot be used to fill the disk
+	cr := &countReader{r: rc}
+	err = is.Create(ctx, img, struct {
+		io.Reader
+		io.Closer
+	}{cr, rc})
+	if err == zip.ErrChecksum || err == zip.ErrFormat {
+		err = ErrZipInvalid
+	}
+	return cr.n, err
+}
+
+// zipEntryName returns the filename an entry is imported as.  An empty
+// name means the entry is skipped, a reason is given unless the entry is
+// a directory or hidden file which are skipped without mention.
+func zipEntryName(f *zip.File) (string, string) {
+	if f.FileInfo().IsDir() || strings.HasSuffix(f.Name, "/") {
+		return "", ""
+	}
+	name := strings.ReplaceAll(f.Name, "\\", "/")
+	if path.IsAbs(name) {
+		return "", "unsafe path"
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", "unsafe path"
+		}
+		if strings.HasPrefix(part, ".") || part == "__MACOSX" {
+			return "", ""
+		}
+	}
+	if !f.Mode().IsRegular() {
+		return "", "not a regular file"
+	}
+	name = path.Base(name)
+	if _, ok := permittedTypes[strings.ToLower(path.Ext(name))]; !ok {
+		return "", ErrImageType.Public()
+	}
+	return name, ""
+}
+
+// countReader keeps track of the number of bytes read through it
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
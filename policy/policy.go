@@ -0,0 +1,107 @@
+// Package policy decides what users are allowed to do.  Controllers and
+// middleware ask the policy instead of comparing owners themselves so new
+// resources and roles only need to be added here.
+package policy
+
+import (
+	"lenslocked.com/models"
+)
+
+// Action is something a user wants to do, with a resource or without one
+type Action string
+
+const (
+	// CreateContent is creating new galleries and collections, it needs
+	// no resource
+	CreateContent Action = "content:create"
+	// Administer is using the admin dashboard to manage every account and
+	// gallery, it needs no resource
+	Administer Action = "admin"
+
+	// ViewGallery is seeing a gallery and its images
+	ViewGallery Action = "gallery:view"
+	// UploadImages is adding images to a gallery
+	UploadImages Action = "gallery:upload"
+	// EditGallery is changing a gallery's settings and its images
+	EditGallery Action = "gallery:edit"
+	// ManageGallery is sharing, moving and deleting a gallery
+	ManageGallery Action = "gallery:manage"
+
+	// ViewCollection is seeing a collection and what is in it
+	ViewCollection Action = "collection:view"
+	// EditCollection is changing, deleting or adding galleries to a
+	// collection
+	EditCollection Action = "collection:edit"
+
+	// EditUpload is continuing or cancelling a resumable upload
+	EditUpload Action = "upload:edit"
+)
+
+// galleryRoles is the role a user needs on a gallery for each action
+var galleryRoles = map[Action]string{
+	ViewGallery:   models.RoleViewer,
+	UploadImages:  models.RoleContributor,
+	EditGallery:   models.RoleEditor,
+	ManageGallery: models.RoleOwner,
+}
+
+// Roles looks up the role a user has on a gallery, it is satisfied by
+// models.CollaboratorService
+type Roles interface {
+	Role(gallery *models.Gallery, userID uint) (string, error)
+}
+
+// New returns a policy that finds users' roles on galleries with roles
+func New(roles Roles) *Policy {
+	return &Policy{roles: roles}
+}
+
+type Policy struct {
+	roles Roles
+}
+
+// Can reports if user may take action on resource.  user is nil for
+// visitors who are not logged in and resource is nil for actions that are
+// not about a particular resource.  Admins can see every gallery so they
+// can review reports of abuse.  Anything the policy does not know about is
+// denied.  The role of the user is recorded on galleries so
+// views can show only what they may do.
+func (p *Policy) Can(user *models.User, action Action, resource interface{}) (bool, error) {
+	var userID uint
+	if user != nil {
+		userID = user.ID
+	}
+	switch res := resource.(type) {
+	case nil:
+		switch action {
+		case CreateContent:
+			return userID != 0, nil
+		case Administer:
+			return userID != 0 && user.Admin && !user.Disabled, nil
+		}
+	case *models.Gallery:
+		want, ok := galleryRoles[action]
+		if !ok {
+			return false, nil
+		}
+		role, err := p.roles.Role(res, userID)
+		if err != nil {
+			return false, err
+		}
+		res.Role = role
+		if action == ViewGallery && (!res.Private || user != nil && user.Admin) {
+			return true, nil
+		}
+		return models.RoleAllows(role, want), nil
+	case *models.Collection:
+		switch action {
+		case ViewCollection:
+			return true, nil
+		case EditCollection:
+			return userID != 0 && res.UserID == userID, nil
+		}
+	case *models.Upload:
+		return action == EditUpload && userID != 0 && res.UserID == userID, nil
+	}
+	return false, nil
+}
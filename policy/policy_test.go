@@ -0,0 +1,137 @@
+package policy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/models"
+)
+
+// stubRoles gives users their role on every gallery without a database,
+// owners are found from the gallery like models.CollaboratorService does
+type stubRoles map[uint]string
+
+func (s stubRoles) Role(gallery *models.Gallery, userID uint) (string, error) {
+	if userID == 0 {
+		return "", nil
+	}
+	if gallery.UserID == userID {
+		return models.RoleOwner, nil
+	}
+	return s[userID], nil
+}
+
+var (
+	owner       = &models.User{Model: gorm.Model{ID: 1}}
+	viewer      = &models.User{Model: gorm.Model{ID: 2}}
+	contributor = &models.User{Model: gorm.Model{ID: 3}}
+	editor      = &models.User{Model: gorm.Model{ID: 4}}
+	stranger    = &models.User{Model: gorm.Model{ID: 5}}
+	admin       = &models.User{Model: gorm.Model{ID: 6}, Admin: true}
+	disabled    = &models.User{Model: gorm.Model{ID: 7}, Admin: true, Disabled: true}
+
+	roles = stubRoles{
+		viewer.ID:      models.RoleViewer,
+		contributor.ID: models.RoleContributor,
+		editor.ID:      models.RoleEditor,
+	}
+)
+
+const unknown Action = "gallery:destroy"
+
+func TestCan(t *testing.T) {
+	gallery := func(private bool) func() interface{} {
+		return func() interface{} {
+			return &models.Gallery{Model: gorm.Model{ID: 10}, UserID: owner.ID, Private: private}
+		}
+	}
+	collection := func() interface{} {
+		return &models.Collection{Model: gorm.Model{ID: 20}, UserID: owner.ID}
+	}
+	upload := func() interface{} {
+		return &models.Upload{Model: gorm.Model{ID: 30}, UserID: owner.ID, GalleryID: 10}
+	}
+	none := func() interface{} { return nil }
+
+	tests := []struct {
+		name     string
+		user     *models.User
+		resource func() interface{}
+		allowed  []Action
+	}{
+		{"owner public gallery", owner, gallery(false), []Action{ViewGallery, UploadImages, EditGallery, ManageGallery}},
+		{"owner private gallery", owner, gallery(true), []Action{ViewGallery, UploadImages, EditGallery, ManageGallery}},
+		{"editor public gallery", editor, gallery(false), []Action{ViewGallery, UploadImages, EditGallery}},
+		{"editor private gallery", editor, gallery(true), []Action{ViewGallery, UploadImages, EditGallery}},
+		{"contributor public gallery", contributor, gallery(false), []Action{ViewGallery, UploadImages}},
+		{"contributor private gallery", contributor, gallery(true), []Action{ViewGallery, UploadImages}},
+		{"viewer public gallery", viewer, gallery(false), []Action{ViewGallery}},
+		{"viewer private gallery", viewer, gallery(true), []Action{ViewGallery}},
+		{"stranger public gallery", stranger, gallery(false), []Action{ViewGallery}},
+		{"stranger private gallery", stranger, gallery(true), nil},
+		{"visitor public gallery", nil, gallery(false), []Action{ViewGallery}},
+		{"visitor private gallery", nil, gallery(true), nil},
+		{"admin public gallery", admin, gallery(false), []Action{ViewGallery}},
+		{"admin private gallery", admin, gallery(true), []Action{ViewGallery}},
+
+		{"owner collection", owner, collection, []Action{ViewCollection, EditCollection}},
+		{"editor collection", editor, collection, []Action{ViewCollection}},
+		{"stranger collection", stranger, collection, []Action{ViewCollection}},
+		{"visitor collection", nil, collection, []Action{ViewCollection}},
+		{"admin collection", admin, collection, []Action{ViewCollection}},
+
+		{"owner upload", owner, upload, []Action{EditUpload}},
+		{"contributor upload", contributor, upload, nil},
+		{"visitor upload", nil, upload, nil},
+		{"admin upload", admin, upload, nil},
+
+		{"owner no resource", owner, none, []Action{CreateContent}},
+		{"visitor no resource", nil, none, nil},
+		{"admin no resource", admin, none, []Action{CreateContent, Administer}},
+		{"disabled admin no resource", disabled, none, []Action{CreateContent}},
+	}
+	actions := []Action{CreateContent, Administer, ViewGallery, UploadImages, EditGallery,
+		ManageGallery, ViewCollection, EditCollection, EditUpload, unknown}
+	p := New(roles)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, action := range actions {
+				want := false
+				for _, a := range test.allowed {
+					want = want || a == action
+				}
+				got, err := p.Can(test.user, action, test.resource())
+				if err != nil {
+					t.Fatalf("Can(%s) err = %v", action, err)
+				}
+				if got != want {
+					t.Errorf("Can(%s) = %t, want %t", action, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCanRecordsRole(t *testing.T) {
+	gallery := &models.Gallery{UserID: owner.ID}
+	if _, err := New(roles).Can(contributor, ViewGallery, gallery); err != nil {
+		t.Fatal(err)
+	}
+	if gallery.Role != models.RoleContributor {
+		t.Errorf("gallery.Role = %q, want %q", gallery.Role, models.RoleContributor)
+	}
+}
+
+type failingRoles struct{}
+
+func (failingRoles) Role(*models.Gallery, uint) (string, error) {
+	return "", errors.New("db down")
+}
+
+func TestCanRoleError(t *testing.T) {
+	ok, err := New(failingRoles{}).Can(owner, EditGallery, &models.Gallery{UserID: owner.ID})
+	if err == nil || ok {
+		t.Errorf("Can() = %t, %v, want false and an error", ok, err)
+	}
+}
@@ -23,9 +23,11 @@ type Alert struct {
 
 // Data is the top level structure that will be passed to our html templates
 type Data struct {
-	Alert *Alert
-	User  *models.User
-	Yeild interface{}
+	Alert       *Alert
+	User        *models.User
+	Breadcrumbs []Breadcrumb
+	Pagination  *Pagination
+	Yeild       interface{}
 }
 
 // ErrorAlert will set the alert type to be generic if it is not an approved Public Error
@@ -56,3 +58,26 @@ type PublicError interface {
 	error
 	Public() string
 }
+
+// Breadcrumb is one step of the trail shown above nested pages.  The
+// last step is the current page and has no URL.
+type Breadcrumb struct {
+	Name string
+	URL  string
+}
+
+// Pagination holds the links between the pages of a paginated listing.
+// Links that do not apply to the current page are left empty.
+type Pagination struct {
+	First string
+	Prev  string
+	Next  string
+	Pages []PageLink
+}
+
+// PageLink is a link to a single numbered page
+type PageLink struct {
+	Number  int
+	URL     string
+	Current bool
+}
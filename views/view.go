@@ -5,7 +5,6 @@ import (
 	"errors"
 	"html/template"
 	"io"
-	"log"
 	"net/http"
 	"path/filepath"
 
@@ -31,6 +30,9 @@ func NewView(layout string, files ...string) *View {
 		"csrfField": func() (template.HTML, error) {
 			return "", errors.New("csrfField is not yet implemented")
 		},
+		"csrfToken": func() (string, error) {
+			return "", errors.New("csrfToken is not yet implemented")
+		},
 	}).ParseFiles(files...)
 	if err != nil {
 		panic(err)
@@ -67,15 +69,19 @@ func (v View) Render(w http.ResponseWriter, r *http.Request, data interface{}) {
 		}
 	}
 	csrfFeild := csrf.TemplateField(r)
+	csrfToken := csrf.Token(r)
 	tpl := v.Template.Funcs(template.FuncMap{
 		"csrfField": func() template.HTML {
 			return csrfFeild
 		},
+		"csrfToken": func() string {
+			return csrfToken
+		},
 	})
 	vd.User = context.User(r.Context())
 	var buf bytes.Buffer
 	if err := tpl.ExecuteTemplate(&buf, v.Layout, vd); err != nil {
-		log.Println(err)
+		context.Logger(r.Context()).Error("rendering template", "layout", v.Layout, "error", err)
 		http.Error(w, "Oops something went wrong.", http.StatusInternalServerError)
 		return
 	}